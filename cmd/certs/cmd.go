@@ -0,0 +1,26 @@
+package certs
+
+import (
+	"github.com/urfave/cli"
+)
+
+func NewCommand() cli.Command {
+	return cli.Command{
+		Name:  "certs",
+		Usage: "Generates and renews the certificates used to set up mTLS between a Proxy and its Gateways",
+		Subcommands: []cli.Command{
+			{
+				Name:   "generate",
+				Usage:  "Generates a CA, a serving cert for the Proxy and client certs for Gateways, skipping any that already exist",
+				Action: runGenerate,
+				Flags:  generateFlags,
+			},
+			{
+				Name:   "renew",
+				Usage:  "Renews the Proxy and Gateway certs generated in a directory that are about to expire",
+				Action: runRenew,
+				Flags:  renewFlags,
+			},
+		},
+	}
+}
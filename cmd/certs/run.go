@@ -0,0 +1,122 @@
+package certs
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/aiyengar2/portexporter/pkg/certs"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+var (
+	generateFlags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "dir",
+			Usage: "The directory to write certs to",
+			Value: certs.DefaultDir,
+		},
+		cli.StringSliceFlag{
+			Name:  "proxy-san",
+			Usage: "A DNS name or IP address that gateways use to reach the proxy, which the proxy's serving cert is issued for. Can be specified multiple times",
+		},
+		cli.StringSliceFlag{
+			Name:  "gateway",
+			Usage: "The tunnel ID of a gateway (the IP address of its host) to issue a client cert for. Can be specified multiple times",
+		},
+		cli.DurationFlag{
+			Name:  "ca-validity",
+			Usage: "How long a newly created CA is valid for",
+			Value: certs.DefaultCAValidity,
+		},
+		cli.DurationFlag{
+			Name:  "validity",
+			Usage: "How long issued certs are valid for",
+			Value: certs.DefaultValidity,
+		},
+		cli.BoolFlag{
+			Name:  "debug",
+			Usage: "Enable debug logging",
+		},
+	}
+
+	renewFlags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "dir",
+			Usage: "The directory containing certs created by the generate command",
+			Value: certs.DefaultDir,
+		},
+		cli.DurationFlag{
+			Name:  "validity",
+			Usage: "How long renewed certs are valid for",
+			Value: certs.DefaultValidity,
+		},
+		cli.DurationFlag{
+			Name:  "renew-before",
+			Usage: "Renew certs that expire within this long",
+			Value: certs.DefaultRenewBefore,
+		},
+		cli.BoolFlag{
+			Name:  "force",
+			Usage: "Renew every cert regardless of when it expires",
+		},
+		cli.BoolFlag{
+			Name:  "debug",
+			Usage: "Enable debug logging",
+		},
+	}
+)
+
+func runGenerate(cliCtx *cli.Context) (err error) {
+	// parse flags
+	dir := cliCtx.String("dir")
+	proxySANs := cliCtx.StringSlice("proxy-san")
+	gateways := cliCtx.StringSlice("gateway")
+	caValidity := cliCtx.Duration("ca-validity")
+	validity := cliCtx.Duration("validity")
+	debug := cliCtx.Bool("debug")
+
+	if debug {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	cfg := certs.Config{
+		Dir:        dir,
+		ProxySANs:  proxySANs,
+		Gateways:   gateways,
+		CAValidity: caValidity,
+		Validity:   validity,
+	}
+	if err := certs.Generate(cfg); err != nil {
+		return err
+	}
+
+	if len(proxySANs) > 0 {
+		logrus.Infof("Run the proxy with %s", flags(certs.ProxyDir(dir)))
+	}
+	for _, gateway := range gateways {
+		logrus.Infof("Run gateway %s with %s", gateway, flags(certs.GatewayDir(dir, gateway)))
+	}
+	return nil
+}
+
+func runRenew(cliCtx *cli.Context) (err error) {
+	// parse flags
+	dir := cliCtx.String("dir")
+	validity := cliCtx.Duration("validity")
+	renewBefore := cliCtx.Duration("renew-before")
+	force := cliCtx.Bool("force")
+	debug := cliCtx.Bool("debug")
+
+	if debug {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	return certs.Renew(dir, validity, renewBefore, force)
+}
+
+// flags returns the TLS flags that point a component at the certs in a directory
+func flags(dir string) string {
+	return fmt.Sprintf("--cert-file %s --key-file %s --cacert-file %s",
+		filepath.Join(dir, certs.CertFile), filepath.Join(dir, certs.KeyFile), filepath.Join(dir, certs.CaCertFile))
+}
@@ -3,7 +3,9 @@ package gateway
 import (
 	"context"
 
+	"github.com/aiyengar2/portexporter/pkg/config"
 	"github.com/aiyengar2/portexporter/pkg/gateway"
+	"github.com/aiyengar2/portexporter/pkg/redirect"
 	"github.com/rancher/wrangler/pkg/signals"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
@@ -13,19 +15,168 @@ import (
 
 var (
 	runFlags = []cli.Flag{
-		cli.StringFlag{
+		cli.StringSliceFlag{
 			Name:     "proxy-url",
-			Usage:    "The address of the proxy that the gateway must make an outbound connection to (e.g. wss://port-exporter-proxy.port-exporter.svc.cluster.local:8080/connect)",
+			Usage:    "The address of a proxy that the gateway must make an outbound connection to (e.g. wss://port-exporter-proxy.port-exporter.svc.cluster.local:8080/connect). Can be specified multiple times to stay connected to several proxies at once",
 			Required: true,
 		},
+		cli.StringSliceFlag{
+			Name:  "expose",
+			Usage: "An address that proxies are allowed to dial through the gateway, optionally prefixed by tcp:// or udp:// (e.g. 127.0.0.1:9100 or udp://127.0.0.1:8125), or a unix socket (e.g. unix:///var/run/docker.sock) that proxies reach through a virtual host named after the socket file (e.g. docker.sock.<tunnel-id>:0). Connections to exposed addresses are tunneled as is; to originate TLS, configure a named target with --target-config instead. Can be specified multiple times (default: expose all addresses)",
+		},
+		cli.StringSliceFlag{
+			Name:  "target",
+			Usage: "A named target that proxies can dial through the gateway as <name>.<tunnel-id>, in the form NAME=ADDRESS (e.g. node-exporter=127.0.0.1:9100). Can be specified multiple times",
+		},
+		cli.StringFlag{
+			Name:      "target-config",
+			Usage:     "A file containing a list of named targets under 'targets', which can also configure the gateway to originate TLS to them (originateTLS, caCertFile, insecureSkipVerify, tokenFile). TLS can only be originated to targets configured here, not to --expose or --target addresses",
+			TakesFile: true,
+		},
+		cli.StringFlag{
+			Name:      "redirect-config",
+			Usage:     "A redirector configuration file (see the redirector command) whose redirects the gateway serves in-process to proxies that dial <redirect-name>.<tunnel-id>",
+			TakesFile: true,
+		},
+		cli.StringFlag{
+			Name:  "redirect-name",
+			Usage: "The name of the target that proxies dial to reach the in-process redirector",
+			Value: gateway.DefaultRedirectorName,
+		},
+		cli.DurationFlag{
+			Name:  "udp-flow-timeout",
+			Usage: "How long a tunneled UDP flow can go without sending or receiving any datagrams before it is closed",
+			Value: gateway.DefaultUDPFlowTimeout,
+		},
 		cli.StringFlag{
 			Name:  "cacert-file",
 			Usage: "A file containing a TLS cacert used to verify the TLS certs provided by the proxy when setting up a TLS encrypted proxy connection",
 		},
+		cli.StringFlag{
+			Name:  "cert-file",
+			Usage: "A file containing a TLS cert presented to proxies that verify the client certs of gateways",
+		},
+		cli.StringFlag{
+			Name:  "key-file",
+			Usage: "A file containing the TLS key of the cert in cert-file",
+		},
+		cli.StringSliceFlag{
+			Name:  "pin-sha256",
+			Usage: "A base64 encoded SHA-256 hash of the subject public key info of a certificate that the proxy must present (e.g. from 'openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64'). Can be specified multiple times to allow for key rotation",
+		},
 		cli.BoolFlag{
 			Name:  "insecure-skip-verify",
 			Usage: "Whethert to skip verifying certs provided by the proxy when setting up a TLS encrypted proxy connection",
 		},
+		cli.StringFlag{
+			Name:  "tls-preset",
+			Usage: "A named TLS policy to start from (modern or intermediate). Overridden by the other tls flags",
+		},
+		cli.StringFlag{
+			Name:  "tls-min-version",
+			Usage: "The minimum TLS version used to connect to proxies (1.0, 1.1, 1.2 or 1.3)",
+		},
+		cli.StringFlag{
+			Name:  "tls-max-version",
+			Usage: "The maximum TLS version used to connect to proxies (1.0, 1.1, 1.2 or 1.3)",
+		},
+		cli.StringSliceFlag{
+			Name:  "tls-cipher-suites",
+			Usage: "A cipher suite used to connect to proxies for TLS 1.2 and below (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256). Can be specified multiple times",
+		},
+		cli.StringSliceFlag{
+			Name:  "tls-curves",
+			Usage: "An elliptic curve used to connect to proxies for key exchange (X25519, P256, P384 or P521), in order of preference. Can be specified multiple times",
+		},
+		cli.StringFlag{
+			Name:  "upstream-proxy",
+			Usage: "An HTTP(S) proxy that the gateway must go through to reach proxies (e.g. https://egress.example.com:3128) (default: taken from HTTP_PROXY / HTTPS_PROXY)",
+		},
+		cli.StringFlag{
+			Name:      "upstream-proxy-credentials-file",
+			Usage:     "A file containing username:password used to authenticate with the upstream proxy via Basic auth",
+			TakesFile: true,
+		},
+		cli.StringFlag{
+			Name:      "upstream-proxy-cacert-file",
+			Usage:     "A file containing a TLS cacert used to verify the upstream proxy when it is accessed over HTTPS",
+			TakesFile: true,
+		},
+		cli.StringSliceFlag{
+			Name:  "no-proxy",
+			Usage: "A host name, domain (e.g. .example.com), IP or CIDR that is reached without going through the upstream proxy. Can be specified multiple times",
+		},
+		cli.DurationFlag{
+			Name:  "backoff-initial",
+			Usage: "How long to wait before the first attempt to reconnect to a proxy",
+			Value: gateway.DefaultBackoffInitial,
+		},
+		cli.DurationFlag{
+			Name:  "backoff-max",
+			Usage: "The maximum amount of time to wait between attempts to reconnect to a proxy",
+			Value: gateway.DefaultBackoffMax,
+		},
+		cli.Float64Flag{
+			Name:  "backoff-jitter",
+			Usage: "The fraction (between 0 and 1) of each reconnect delay that is randomized to avoid gateways reconnecting in lockstep",
+			Value: gateway.DefaultBackoffJitter,
+		},
+		cli.DurationFlag{
+			Name:  "give-up-after",
+			Usage: "Exit with a non-zero code if the gateway has not had a session with any proxy for this long (default: never give up)",
+		},
+		cli.StringFlag{
+			Name:  "status-listen",
+			Usage: "A local address to serve /healthz, /readyz and /status endpoints for the gateway on (e.g. 127.0.0.1:8090)",
+		},
+		cli.StringFlag{
+			Name:      "audit-log",
+			Usage:     "A file to write a JSON lines audit log of every dial the gateway allows or refuses to, or '-' to write it to stdout",
+			TakesFile: true,
+		},
+		cli.IntFlag{
+			Name:  "audit-log-max-size",
+			Usage: "The size in megabytes that the audit log file can grow to before it is rotated",
+			Value: gateway.DefaultAuditLogMaxSizeMB,
+		},
+		cli.IntFlag{
+			Name:  "audit-log-max-backups",
+			Usage: "The number of rotated audit log files to keep",
+			Value: gateway.DefaultAuditLogMaxBackups,
+		},
+		cli.IntFlag{
+			Name:  "max-connections",
+			Usage: "The maximum number of tunneled connections the gateway keeps open at once (default: unlimited)",
+		},
+		cli.IntFlag{
+			Name:  "max-connections-per-target",
+			Usage: "The maximum number of tunneled connections the gateway keeps open to a single address at once (default: unlimited)",
+		},
+		cli.Float64Flag{
+			Name:  "dial-rate",
+			Usage: "The number of dials per second that proxies are allowed to make through the gateway (default: unlimited)",
+		},
+		cli.IntFlag{
+			Name:  "dial-burst",
+			Usage: "The number of dials that proxies can make at once before the dial rate applies",
+			Value: 1,
+		},
+		cli.Int64Flag{
+			Name:  "bandwidth-limit",
+			Usage: "The maximum rate in bytes per second, in each direction, shared by all connections tunneled through the gateway (default: unlimited)",
+		},
+		cli.Int64Flag{
+			Name:  "bandwidth-limit-per-target",
+			Usage: "The maximum rate in bytes per second, in each direction, shared by all tunneled connections to the same address (default: unlimited)",
+		},
+		cli.Int64Flag{
+			Name:  "bandwidth-limit-per-tunnel",
+			Usage: "The maximum rate in bytes per second, in each direction, shared by all connections requested by the same proxy (default: unlimited)",
+		},
+		cli.StringSliceFlag{
+			Name:  "cert-expiry-warning",
+			Usage: "How long before a loaded or presented TLS cert expires to log a warning (e.g. 720h). Can be specified multiple times (default: 720h, 168h, 24h)",
+		},
 		cli.BoolFlag{
 			Name:  "debug",
 			Usage: "Enable debug logging",
@@ -41,10 +192,43 @@ func run(cliCtx *cli.Context) (err error) {
 	ctx := signals.SetupSignalHandler(context.Background())
 
 	// parse flags
-	proxyUrl := cliCtx.String("proxy-url")
+	proxyUrls := cliCtx.StringSlice("proxy-url")
 	expose := cliCtx.StringSlice("expose")
+	targets := cliCtx.StringSlice("target")
+	targetConfig := cliCtx.String("target-config")
+	redirectConfig := cliCtx.String("redirect-config")
+	redirectName := cliCtx.String("redirect-name")
+	udpFlowTimeout := cliCtx.Duration("udp-flow-timeout")
 	caCertFile := cliCtx.String("cacert-file")
+	certFile := cliCtx.String("cert-file")
+	keyFile := cliCtx.String("key-file")
+	pinSHA256 := cliCtx.StringSlice("pin-sha256")
 	insecureSkipVerify := cliCtx.Bool("insecure-skip-verify")
+	tlsPreset := cliCtx.String("tls-preset")
+	tlsMinVersion := cliCtx.String("tls-min-version")
+	tlsMaxVersion := cliCtx.String("tls-max-version")
+	tlsCipherSuites := cliCtx.StringSlice("tls-cipher-suites")
+	tlsCurves := cliCtx.StringSlice("tls-curves")
+	upstreamProxy := cliCtx.String("upstream-proxy")
+	upstreamProxyCredentialsFile := cliCtx.String("upstream-proxy-credentials-file")
+	upstreamProxyCaCertFile := cliCtx.String("upstream-proxy-cacert-file")
+	noProxy := cliCtx.StringSlice("no-proxy")
+	backoffInitial := cliCtx.Duration("backoff-initial")
+	backoffMax := cliCtx.Duration("backoff-max")
+	backoffJitter := cliCtx.Float64("backoff-jitter")
+	giveUpAfter := cliCtx.Duration("give-up-after")
+	statusListen := cliCtx.String("status-listen")
+	auditLog := cliCtx.String("audit-log")
+	auditLogMaxSize := cliCtx.Int("audit-log-max-size")
+	auditLogMaxBackups := cliCtx.Int("audit-log-max-backups")
+	maxConnections := cliCtx.Int("max-connections")
+	maxConnectionsPerTarget := cliCtx.Int("max-connections-per-target")
+	dialRate := cliCtx.Float64("dial-rate")
+	dialBurst := cliCtx.Int("dial-burst")
+	bandwidthLimit := cliCtx.Int64("bandwidth-limit")
+	bandwidthLimitPerTarget := cliCtx.Int64("bandwidth-limit-per-target")
+	bandwidthLimitPerTunnel := cliCtx.Int64("bandwidth-limit-per-tunnel")
+	certExpiryWarnings := cliCtx.StringSlice("cert-expiry-warning")
 	debug := cliCtx.Bool("debug")
 	printTunnelData := cliCtx.Bool("print-tunnel-data")
 
@@ -53,14 +237,85 @@ func run(cliCtx *cli.Context) (err error) {
 		remotedialer.PrintTunnelData = printTunnelData
 	}
 
+	expiryWarnings, err := config.ParseExpiryWarnings(certExpiryWarnings)
+	if err != nil {
+		return err
+	}
+	config.MonitorExpiry(ctx, expiryWarnings)
+
 	cfg := gateway.Config{
 		Expose: expose,
+		Backoff: gateway.Backoff{
+			Initial: backoffInitial,
+			Max:     backoffMax,
+			Jitter:  backoffJitter,
+		},
+		UpstreamProxy: gateway.UpstreamProxy{
+			URL:             upstreamProxy,
+			CredentialsFile: upstreamProxyCredentialsFile,
+			CaCertFile:      upstreamProxyCaCertFile,
+			NoProxy:         noProxy,
+		},
+		Audit: gateway.Audit{
+			Path:       auditLog,
+			MaxSizeMB:  auditLogMaxSize,
+			MaxBackups: auditLogMaxBackups,
+		},
+		Limits: gateway.Limits{
+			MaxConnections:          maxConnections,
+			MaxConnectionsPerTarget: maxConnectionsPerTarget,
+			DialRate:                dialRate,
+			DialBurst:               dialBurst,
+		},
+		Bandwidth: gateway.Bandwidth{
+			Limit:          bandwidthLimit,
+			LimitPerTarget: bandwidthLimitPerTarget,
+			LimitPerTunnel: bandwidthLimitPerTunnel,
+		},
+		UDPFlowTimeout: udpFlowTimeout,
+		GiveUpAfter:    giveUpAfter,
+		StatusAddress:  statusListen,
+	}
+
+	if targetConfig != "" {
+		cfg.Targets, err = gateway.LoadTargets(targetConfig)
+		if err != nil {
+			return err
+		}
+	}
+	for _, t := range targets {
+		target, err := gateway.ParseTarget(t)
+		if err != nil {
+			return err
+		}
+		cfg.Targets = append(cfg.Targets, target)
+	}
+
+	if redirectConfig != "" {
+		cfg.Redirector.Name = redirectName
+		cfg.Redirector.Config, err = redirect.Load(redirectConfig)
+		if err != nil {
+			return err
+		}
 	}
 
 	cfg.InsecureSkipVerify = insecureSkipVerify
 	cfg.CaCertFile = caCertFile
+	cfg.CertFile = certFile
+	cfg.KeyFile = keyFile
+	cfg.PinnedSHA256 = pinSHA256
+	cfg.Policy = config.TLSPolicy{
+		Preset:       tlsPreset,
+		MinVersion:   tlsMinVersion,
+		MaxVersion:   tlsMaxVersion,
+		CipherSuites: tlsCipherSuites,
+		Curves:       tlsCurves,
+	}
 
-	g := gateway.NewServer(proxyUrl, cfg)
+	g, err := gateway.NewServer(proxyUrls, cfg)
+	if err != nil {
+		return err
+	}
 
 	return g.Start(ctx)
 }
@@ -5,6 +5,7 @@ import (
 
 	"github.com/aiyengar2/portexporter/pkg/config"
 	"github.com/aiyengar2/portexporter/pkg/proxy"
+	"github.com/aiyengar2/portexporter/pkg/status"
 	"github.com/rancher/remotedialer"
 	"github.com/rancher/wrangler/pkg/signals"
 	"github.com/sirupsen/logrus"
@@ -30,6 +31,59 @@ var (
 			Name:  "cacert-file",
 			Usage: "A file containing a caCert to be used to verify incoming TLS encrypted proxy connections",
 		},
+		cli.StringSliceFlag{
+			Name:  "sni-cert",
+			Usage: "A TLS cert and key, in the form CERT_FILE,KEY_FILE, served instead of the cert in cert-file to clients requesting a server name that the cert is valid for. Can be specified multiple times",
+		},
+		cli.StringSliceFlag{
+			Name:  "crl-file",
+			Usage: "A file containing a certificate revocation list, signed by the cacert, of gateway client certs to reject. Reloaded on change. Can be specified multiple times",
+		},
+		cli.StringFlag{
+			Name:  "deny-list-file",
+			Usage: "A file listing the serial numbers or SHA-256 fingerprints of gateway client certs to reject, one per line. Reloaded on change",
+		},
+		cli.BoolFlag{
+			Name:  "strict-tls",
+			Usage: "Fail instead of ignoring incomplete TLS configuration, such as a cacert file provided without a cert file and key file",
+		},
+		cli.StringFlag{
+			Name:  "tls-preset",
+			Usage: "A named TLS policy to start from (modern or intermediate). Overridden by the other tls flags",
+		},
+		cli.StringFlag{
+			Name:  "tls-min-version",
+			Usage: "The minimum TLS version accepted from clients (1.0, 1.1, 1.2 or 1.3)",
+		},
+		cli.StringFlag{
+			Name:  "tls-max-version",
+			Usage: "The maximum TLS version accepted from clients (1.0, 1.1, 1.2 or 1.3)",
+		},
+		cli.StringSliceFlag{
+			Name:  "tls-cipher-suites",
+			Usage: "A cipher suite accepted from clients for TLS 1.2 and below (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256). Can be specified multiple times",
+		},
+		cli.StringSliceFlag{
+			Name:  "tls-curves",
+			Usage: "An elliptic curve accepted from clients for key exchange (X25519, P256, P384 or P521), in order of preference. Can be specified multiple times",
+		},
+		cli.StringSliceFlag{
+			Name:  "udp-forward",
+			Usage: "Forward UDP datagrams received on a local address to an address on the network of a gateway, in the form LISTEN=TUNNEL_ID/TARGET (e.g. :8125=10.0.0.7/127.0.0.1:8125). Can be specified multiple times",
+		},
+		cli.DurationFlag{
+			Name:  "udp-flow-timeout",
+			Usage: "How long a forwarded UDP flow can go without sending or receiving any datagrams before it is closed",
+			Value: proxy.DefaultUDPFlowTimeout,
+		},
+		cli.StringFlag{
+			Name:  "status-listen",
+			Usage: "The local address to serve /healthz, /status (including the expiry of TLS certs) and /metrics on. If unset, none are served",
+		},
+		cli.StringSliceFlag{
+			Name:  "cert-expiry-warning",
+			Usage: "How long before a loaded or presented TLS cert expires to log a warning (e.g. 720h). Can be specified multiple times (default: 720h, 168h, 24h)",
+		},
 		cli.BoolFlag{
 			Name:  "debug",
 			Usage: "Enable debug logging",
@@ -49,6 +103,19 @@ func run(cliCtx *cli.Context) (err error) {
 	certFile := cliCtx.String("cert-file")
 	keyFile := cliCtx.String("key-file")
 	caCertFile := cliCtx.String("cacert-file")
+	sniCerts := cliCtx.StringSlice("sni-cert")
+	crlFiles := cliCtx.StringSlice("crl-file")
+	denyListFile := cliCtx.String("deny-list-file")
+	strictTLS := cliCtx.Bool("strict-tls")
+	tlsPreset := cliCtx.String("tls-preset")
+	tlsMinVersion := cliCtx.String("tls-min-version")
+	tlsMaxVersion := cliCtx.String("tls-max-version")
+	tlsCipherSuites := cliCtx.StringSlice("tls-cipher-suites")
+	tlsCurves := cliCtx.StringSlice("tls-curves")
+	udpForwards := cliCtx.StringSlice("udp-forward")
+	udpFlowTimeout := cliCtx.Duration("udp-flow-timeout")
+	statusListen := cliCtx.String("status-listen")
+	certExpiryWarnings := cliCtx.StringSlice("cert-expiry-warning")
 	debug := cliCtx.Bool("debug")
 	printTunnelData := cliCtx.Bool("print-tunnel-data")
 
@@ -57,12 +124,51 @@ func run(cliCtx *cli.Context) (err error) {
 		remotedialer.PrintTunnelData = printTunnelData
 	}
 
-	cfg := config.TLSServer{
-		CertFile:   certFile,
-		KeyFile:    keyFile,
-		CaCertFile: caCertFile,
+	expiryWarnings, err := config.ParseExpiryWarnings(certExpiryWarnings)
+	if err != nil {
+		return err
+	}
+	config.MonitorExpiry(ctx, expiryWarnings)
+	if statusListen != "" {
+		status.NewServer(statusListen).Start(ctx)
+	}
+
+	cfg := proxy.Config{
+		TLSServer: config.TLSServer{
+			CertFile:     certFile,
+			KeyFile:      keyFile,
+			CaCertFile:   caCertFile,
+			CRLFiles:     crlFiles,
+			DenyListFile: denyListFile,
+			Strict:       strictTLS,
+			Policy: config.TLSPolicy{
+				Preset:       tlsPreset,
+				MinVersion:   tlsMinVersion,
+				MaxVersion:   tlsMaxVersion,
+				CipherSuites: tlsCipherSuites,
+				Curves:       tlsCurves,
+			},
+		},
+	}
+	for _, c := range sniCerts {
+		keyPair, err := config.ParseKeyPair(c)
+		if err != nil {
+			return err
+		}
+		cfg.SNICertificates = append(cfg.SNICertificates, keyPair)
+	}
+	for _, f := range udpForwards {
+		forward, err := proxy.ParseUDPForward(f)
+		if err != nil {
+			return err
+		}
+		forward.FlowTimeout = udpFlowTimeout
+		cfg.UDPForward = append(cfg.UDPForward, forward)
+	}
+	s, err := proxy.NewServer(listen, cfg)
+	if err != nil {
+		return err
 	}
-	s := proxy.NewServer(listen, cfg)
 
 	return s.Start(ctx)
 }
@@ -2,8 +2,12 @@ package redirector
 
 import (
 	"context"
+	"fmt"
+	"path/filepath"
 
+	"github.com/aiyengar2/portexporter/pkg/config"
 	"github.com/aiyengar2/portexporter/pkg/redirect"
+	"github.com/aiyengar2/portexporter/pkg/status"
 	"github.com/rancher/remotedialer"
 	"github.com/rancher/wrangler/pkg/signals"
 	"github.com/sirupsen/logrus"
@@ -23,6 +27,79 @@ var (
 			TakesFile: true,
 			Value:     redirect.DefaultRedirectConfigFile,
 		},
+		cli.StringFlag{
+			Name:  "cert-file",
+			Usage: "A file containing a TLS cert used to set up TLS encrypted connections to the redirector",
+		},
+		cli.StringFlag{
+			Name:  "key-file",
+			Usage: "A file containing a TLS key used to set up TLS encrypted connections to the redirector",
+		},
+		cli.StringFlag{
+			Name:  "cacert-file",
+			Usage: "A file containing a caCert to be used to verify the client certs of incoming TLS encrypted connections",
+		},
+		cli.BoolFlag{
+			Name:  "strict-tls",
+			Usage: "Fail instead of ignoring incomplete TLS configuration, such as a cacert file provided without a cert file and key file",
+		},
+		cli.StringFlag{
+			Name:  "tls-preset",
+			Usage: "A named TLS policy to start from (modern or intermediate). Overridden by the other tls flags",
+		},
+		cli.StringFlag{
+			Name:  "tls-min-version",
+			Usage: "The minimum TLS version accepted from clients (1.0, 1.1, 1.2 or 1.3)",
+		},
+		cli.StringFlag{
+			Name:  "tls-max-version",
+			Usage: "The maximum TLS version accepted from clients (1.0, 1.1, 1.2 or 1.3)",
+		},
+		cli.StringSliceFlag{
+			Name:  "tls-cipher-suites",
+			Usage: "A cipher suite accepted from clients for TLS 1.2 and below (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256). Can be specified multiple times",
+		},
+		cli.StringSliceFlag{
+			Name:  "tls-curves",
+			Usage: "An elliptic curve accepted from clients for key exchange (X25519, P256, P384 or P521), in order of preference. Can be specified multiple times",
+		},
+		cli.StringFlag{
+			Name:  "admin-listen",
+			Usage: "The address to serve an API that lists, gets, creates, updates and deletes redirects on. If unset, it is not served",
+		},
+		cli.StringFlag{
+			Name:  "admin-cert-file",
+			Usage: "A file containing a TLS cert used to set up TLS encrypted connections to the admin API. If unset, the admin API is served over HTTP",
+		},
+		cli.StringFlag{
+			Name:  "admin-key-file",
+			Usage: "A file containing a TLS key used to set up TLS encrypted connections to the admin API",
+		},
+		cli.StringFlag{
+			Name:  "admin-cacert-file",
+			Usage: "A file containing a caCert to be used to verify the client certs of incoming TLS encrypted connections to the admin API",
+		},
+		cli.StringFlag{
+			Name:      "admin-token-file",
+			Usage:     "A file containing the bearer token that requests to the admin API must carry. Required if --admin-listen is set",
+			TakesFile: true,
+		},
+		cli.StringFlag{
+			Name:  "admin-credentials-dir",
+			Usage: "An absolute path to the directory that redirects created or updated through the admin API can read token, credential and TLS files from. If unset, they cannot reference any files",
+		},
+		cli.BoolFlag{
+			Name:  "admin-persist",
+			Usage: "Write changes made through the admin API back to the configuration file. Otherwise, they are lost the next time the configuration file changes",
+		},
+		cli.StringFlag{
+			Name:  "status-listen",
+			Usage: "The local address to serve /healthz, /status (including the expiry of TLS certs) and /metrics on. If unset, none are served",
+		},
+		cli.StringSliceFlag{
+			Name:  "cert-expiry-warning",
+			Usage: "How long before a loaded or presented TLS cert expires to log a warning (e.g. 720h). Can be specified multiple times (default: 720h, 168h, 24h)",
+		},
 		cli.BoolFlag{
 			Name:  "debug",
 			Usage: "Enable debug logging",
@@ -35,7 +112,25 @@ func run(cliCtx *cli.Context) (err error) {
 
 	// parse flags
 	listen := cliCtx.String("listen")
-	config := cliCtx.String("config")
+	configFile := cliCtx.String("config")
+	certFile := cliCtx.String("cert-file")
+	keyFile := cliCtx.String("key-file")
+	caCertFile := cliCtx.String("cacert-file")
+	strictTLS := cliCtx.Bool("strict-tls")
+	tlsPreset := cliCtx.String("tls-preset")
+	tlsMinVersion := cliCtx.String("tls-min-version")
+	tlsMaxVersion := cliCtx.String("tls-max-version")
+	tlsCipherSuites := cliCtx.StringSlice("tls-cipher-suites")
+	tlsCurves := cliCtx.StringSlice("tls-curves")
+	adminListen := cliCtx.String("admin-listen")
+	adminCertFile := cliCtx.String("admin-cert-file")
+	adminKeyFile := cliCtx.String("admin-key-file")
+	adminCaCertFile := cliCtx.String("admin-cacert-file")
+	adminTokenFile := cliCtx.String("admin-token-file")
+	adminCredentialsDir := cliCtx.String("admin-credentials-dir")
+	adminPersist := cliCtx.Bool("admin-persist")
+	statusListen := cliCtx.String("status-listen")
+	certExpiryWarnings := cliCtx.StringSlice("cert-expiry-warning")
 	debug := cliCtx.Bool("debug")
 
 	if debug {
@@ -43,11 +138,63 @@ func run(cliCtx *cli.Context) (err error) {
 		remotedialer.PrintTunnelData = true
 	}
 
-	cfg, err := redirect.Load(config)
+	expiryWarnings, err := config.ParseExpiryWarnings(certExpiryWarnings)
+	if err != nil {
+		return err
+	}
+	config.MonitorExpiry(ctx, expiryWarnings)
+	if statusListen != "" {
+		status.NewServer(statusListen).Start(ctx)
+	}
+
+	cfg, err := redirect.Load(configFile)
 	if err != nil {
 		logrus.Fatal(err)
 	}
-	s := redirect.NewServer(listen, cfg)
+	tlsCfg := config.TLSServer{
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		CaCertFile: caCertFile,
+		Strict:     strictTLS,
+		Policy: config.TLSPolicy{
+			Preset:       tlsPreset,
+			MinVersion:   tlsMinVersion,
+			MaxVersion:   tlsMaxVersion,
+			CipherSuites: tlsCipherSuites,
+			Curves:       tlsCurves,
+		},
+	}
+	s, err := redirect.NewServer(listen, cfg, tlsCfg)
+	if err != nil {
+		return err
+	}
+	if err := s.WatchConfig(ctx, configFile); err != nil {
+		return err
+	}
+	if adminListen != "" {
+		if adminTokenFile == "" {
+			return fmt.Errorf("--admin-token-file is required to serve the admin API")
+		}
+		var persistFile string
+		if adminPersist {
+			persistFile = configFile
+		}
+		adminTLSCfg := config.TLSServer{
+			CertFile:   adminCertFile,
+			KeyFile:    adminKeyFile,
+			CaCertFile: adminCaCertFile,
+			Strict:     strictTLS,
+			Policy:     tlsCfg.Policy,
+		}
+		if adminCredentialsDir != "" && !filepath.IsAbs(adminCredentialsDir) {
+			return fmt.Errorf("--admin-credentials-dir must be an absolute path")
+		}
+		admin, err := redirect.NewAdminServer(adminListen, adminTokenFile, persistFile, adminCredentialsDir, adminTLSCfg, s)
+		if err != nil {
+			return err
+		}
+		admin.Start(ctx)
+	}
 
 	return s.Start(ctx)
 }
@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/aiyengar2/portexporter/pkg/config"
+	"github.com/aiyengar2/portexporter/pkg/status"
 	"github.com/rancher/wrangler/pkg/signals"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
@@ -19,6 +20,14 @@ var (
 			Usage: "The address to listen to incoming HTTP requests on",
 			Value: ":8081",
 		},
+		cli.StringFlag{
+			Name:  "status-listen",
+			Usage: "The local address to serve /healthz, /status (including the expiry of TLS certs) and /metrics on. If unset, none are served",
+		},
+		cli.StringSliceFlag{
+			Name:  "cert-expiry-warning",
+			Usage: "How long before a loaded or presented TLS cert expires to log a warning (e.g. 720h). Can be specified multiple times (default: 720h, 168h, 24h)",
+		},
 		cli.BoolFlag{
 			Name:  "debug",
 			Usage: "Enable debug logging",
@@ -35,6 +44,30 @@ var (
 			Name:  "cacert-file",
 			Usage: "A file containing a caCert to be used to verify incoming TLS encrypted proxy connections",
 		},
+		cli.BoolFlag{
+			Name:  "strict-tls",
+			Usage: "Fail instead of ignoring incomplete TLS configuration, such as a cacert file provided without a cert file and key file",
+		},
+		cli.StringFlag{
+			Name:  "tls-preset",
+			Usage: "A named TLS policy to start from (modern or intermediate). Overridden by the other tls flags",
+		},
+		cli.StringFlag{
+			Name:  "tls-min-version",
+			Usage: "The minimum TLS version accepted from clients (1.0, 1.1, 1.2 or 1.3)",
+		},
+		cli.StringFlag{
+			Name:  "tls-max-version",
+			Usage: "The maximum TLS version accepted from clients (1.0, 1.1, 1.2 or 1.3)",
+		},
+		cli.StringSliceFlag{
+			Name:  "tls-cipher-suites",
+			Usage: "A cipher suite accepted from clients for TLS 1.2 and below (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256). Can be specified multiple times",
+		},
+		cli.StringSliceFlag{
+			Name:  "tls-curves",
+			Usage: "An elliptic curve accepted from clients for key exchange (X25519, P256, P384 or P521), in order of preference. Can be specified multiple times",
+		},
 	}
 )
 
@@ -46,22 +79,52 @@ func run(cliCtx *cli.Context) (err error) {
 	certFile := cliCtx.String("cert-file")
 	keyFile := cliCtx.String("key-file")
 	caCertFile := cliCtx.String("cacert-file")
+	strictTLS := cliCtx.Bool("strict-tls")
+	tlsPreset := cliCtx.String("tls-preset")
+	tlsMinVersion := cliCtx.String("tls-min-version")
+	tlsMaxVersion := cliCtx.String("tls-max-version")
+	tlsCipherSuites := cliCtx.StringSlice("tls-cipher-suites")
+	tlsCurves := cliCtx.StringSlice("tls-curves")
+	statusListen := cliCtx.String("status-listen")
+	certExpiryWarnings := cliCtx.StringSlice("cert-expiry-warning")
 	debug := cliCtx.Bool("debug")
 
 	if debug {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
 
+	expiryWarnings, err := config.ParseExpiryWarnings(certExpiryWarnings)
+	if err != nil {
+		return err
+	}
+	config.MonitorExpiry(ctx, expiryWarnings)
+	if statusListen != "" {
+		status.NewServer(statusListen).Start(ctx)
+	}
+
 	cfg := config.TLSServer{
 		CertFile:   certFile,
 		KeyFile:    keyFile,
 		CaCertFile: caCertFile,
+		Strict:     strictTLS,
+		Policy: config.TLSPolicy{
+			Preset:       tlsPreset,
+			MinVersion:   tlsMinVersion,
+			MaxVersion:   tlsMaxVersion,
+			CipherSuites: tlsCipherSuites,
+			Curves:       tlsCurves,
+		},
+	}
+
+	tlsConfig, err := cfg.TLSConfig(ctx)
+	if err != nil {
+		return err
 	}
 
 	server := http.Server{
 		Addr:      listen,
 		Handler:   &testHandler{},
-		TLSConfig: cfg.TLSConfig(listen),
+		TLSConfig: tlsConfig,
 	}
 	go func() {
 		if cfg.CertFile == "" || cfg.KeyFile == "" {
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/aiyengar2/portexporter/cmd/certs"
 	"github.com/aiyengar2/portexporter/cmd/gateway"
 	"github.com/aiyengar2/portexporter/cmd/proxy"
 	"github.com/aiyengar2/portexporter/cmd/redirector"
@@ -55,6 +56,7 @@ func main() {
 	}
 
 	app.Commands = []cli.Command{
+		certs.NewCommand(),
 		gateway.NewCommand(),
 		proxy.NewCommand(),
 		redirector.NewCommand(),
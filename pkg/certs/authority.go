@@ -0,0 +1,199 @@
+package certs
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"time"
+)
+
+// Authority is a CA that issues the serving certificates of proxies and the client certificates of gateways
+type Authority struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// NewAuthority returns a self-signed CA that is valid for the provided duration
+func NewAuthority(commonName string, validity time.Duration) (*Authority, error) {
+	key, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create CA certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &Authority{Cert: cert, Key: key}, nil
+}
+
+// LoadAuthority loads a CA from a PEM encoded certificate and private key
+func LoadAuthority(certFile, keyFile string) (*Authority, error) {
+	cert, err := LoadCertificate(certFile)
+	if err != nil {
+		return nil, err
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("certificate in %s is not a CA certificate", certFile)
+	}
+	key, err := LoadKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &Authority{Cert: cert, Key: key}, nil
+}
+
+// Issue signs a certificate for the key that is based on the template, valid from now for the provided duration
+func (a *Authority) Issue(template *x509.Certificate, key crypto.PublicKey, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	cert := *template
+	cert.SerialNumber = serial
+	cert.NotBefore = now.Add(-time.Hour)
+	cert.NotAfter = now.Add(validity)
+	if cert.NotAfter.After(a.Cert.NotAfter) {
+		// a certificate cannot be used past the expiry of the CA that issued it
+		cert.NotAfter = a.Cert.NotAfter
+	}
+	cert.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	cert.BasicConstraintsValid = true
+	cert.IsCA = false
+	der, err := x509.CreateCertificate(rand.Reader, &cert, a.Cert, key, a.Key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to issue certificate for %s: %s", template.Subject.CommonName, err)
+	}
+	return x509.ParseCertificate(der)
+}
+
+// serverTemplate returns the template of a serving certificate that is valid for the provided DNS names and IP addresses
+func serverTemplate(commonName string, sans []string) *x509.Certificate {
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, san := range sans {
+		if ip := net.ParseIP(san); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, san)
+		}
+	}
+	return template
+}
+
+// clientTemplate returns the template of a client certificate that identifies a gateway by its tunnel ID,
+// as both the common name and a subject alternative name
+func clientTemplate(tunnelID string) *x509.Certificate {
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: tunnelID},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if ip := net.ParseIP(tunnelID); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{tunnelID}
+	}
+	return template
+}
+
+// renewalTemplate returns a template that issues a certificate with the same identity as an existing certificate
+func renewalTemplate(cert *x509.Certificate) *x509.Certificate {
+	return &x509.Certificate{
+		Subject:     cert.Subject,
+		DNSNames:    cert.DNSNames,
+		IPAddresses: cert.IPAddresses,
+		ExtKeyUsage: cert.ExtKeyUsage,
+	}
+}
+
+// LoadCertificate loads the first certificate from a PEM encoded file
+func LoadCertificate(certFile string) (*x509.Certificate, error) {
+	certBytes, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(certBytes)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no PEM encoded certificate found in %s", certFile)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// LoadKey loads a PEM encoded EC, PKCS#1 or PKCS#8 private key
+func LoadKey(keyFile string) (crypto.Signer, error) {
+	keyBytes, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded private key found in %s", keyFile)
+	}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key in %s", keyFile)
+		}
+		return signer, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %s in %s", block.Type, keyFile)
+	}
+}
+
+func encodeCertificate(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+func encodeKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func newKey() (crypto.Signer, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// newSerial returns a random 128 bit serial number
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1,213 @@
+package certs
+
+import (
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultDir         = "certs"
+	DefaultCAValidity  = 10 * 365 * 24 * time.Hour
+	DefaultValidity    = 365 * 24 * time.Hour
+	DefaultRenewBefore = 30 * 24 * time.Hour
+
+	// CertFile, KeyFile and CaCertFile are the files in each directory of the layout, named after
+	// the --cert-file, --key-file and --cacert-file flags of the component that uses the directory
+	CertFile   = "cert.pem"
+	KeyFile    = "key.pem"
+	CaCertFile = "cacert.pem"
+
+	caDir       = "ca"
+	proxyDir    = "proxy"
+	gatewaysDir = "gateways"
+
+	caCommonName    = "portexporter-ca"
+	proxyCommonName = "portexporter-proxy"
+)
+
+// Config configures the certificates generated in a directory, which is laid out as follows:
+//
+//	ca/{cert,key}.pem                          the CA that issues every other certificate
+//	proxy/{cert,key,cacert}.pem                the serving certificate of the proxy
+//	gateways/<tunnel ID>/{cert,key,cacert}.pem the client certificate of each gateway
+type Config struct {
+	Dir string
+	// ProxySANs are the DNS names and IP addresses that the serving certificate of the proxy is valid for
+	ProxySANs []string
+	// Gateways are the tunnel IDs of the gateways to generate client certificates for
+	Gateways []string
+	// CAValidity and Validity are how long the CA and the certificates it issues are valid for
+	CAValidity time.Duration
+	Validity   time.Duration
+}
+
+// Generate creates the CA if it does not exist yet and uses it to issue any requested certificates that do not exist yet.
+// Existing certificates are left untouched and have to be renewed instead
+func Generate(config Config) error {
+	ca, err := loadOrCreateAuthority(config.Dir, config.CAValidity)
+	if err != nil {
+		return err
+	}
+	if len(config.ProxySANs) > 0 {
+		if err := issue(ca, ProxyDir(config.Dir), serverTemplate(proxyCommonName, config.ProxySANs), config.Validity); err != nil {
+			return err
+		}
+	}
+	for _, tunnelID := range config.Gateways {
+		if tunnelID == "" || tunnelID != filepath.Base(tunnelID) || tunnelID == "." || tunnelID == ".." {
+			return fmt.Errorf("invalid gateway tunnel ID %q", tunnelID)
+		}
+		if err := issue(ca, GatewayDir(config.Dir, tunnelID), clientTemplate(tunnelID), config.Validity); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Renew re-issues the certificates of the proxy and gateways in a directory that expire within renewBefore, or all of them
+// if force is set. Renewed certificates keep their identity and private key, so SPKI pins of the proxy remain valid
+func Renew(dir string, validity, renewBefore time.Duration, force bool) error {
+	ca, err := LoadAuthority(filepath.Join(dir, caDir, CertFile), filepath.Join(dir, caDir, KeyFile))
+	if err != nil {
+		return fmt.Errorf("unable to load CA from %s: %s", filepath.Join(dir, caDir), err)
+	}
+	certDirs := []string{ProxyDir(dir)}
+	gatewayDirs, err := ioutil.ReadDir(filepath.Join(dir, gatewaysDir))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, gatewayDir := range gatewayDirs {
+		if gatewayDir.IsDir() {
+			certDirs = append(certDirs, GatewayDir(dir, gatewayDir.Name()))
+		}
+	}
+	for _, certDir := range certDirs {
+		certFile := filepath.Join(certDir, CertFile)
+		cert, err := LoadCertificate(certFile)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !force && time.Until(cert.NotAfter) > renewBefore {
+			logrus.Infof("Skipping %s, which expires at %s", certFile, cert.NotAfter.Format(time.RFC3339))
+			continue
+		}
+		key, err := LoadKey(filepath.Join(certDir, KeyFile))
+		if err != nil {
+			return err
+		}
+		renewed, err := ca.Issue(renewalTemplate(cert), key.Public(), validity)
+		if err != nil {
+			return err
+		}
+		if err := writeCertificate(certDir, ca, renewed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ProxyDir returns the directory containing the certificate of the proxy
+func ProxyDir(dir string) string {
+	return filepath.Join(dir, proxyDir)
+}
+
+// GatewayDir returns the directory containing the certificate of the gateway with the tunnel ID
+func GatewayDir(dir, tunnelID string) string {
+	return filepath.Join(dir, gatewaysDir, tunnelID)
+}
+
+func loadOrCreateAuthority(dir string, validity time.Duration) (*Authority, error) {
+	certFile, keyFile := filepath.Join(dir, caDir, CertFile), filepath.Join(dir, caDir, KeyFile)
+	if _, err := os.Stat(certFile); err == nil {
+		logrus.Infof("Using existing CA in %s", filepath.Join(dir, caDir))
+		return LoadAuthority(certFile, keyFile)
+	}
+	ca, err := NewAuthority(caCommonName, validity)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeKey(filepath.Join(dir, caDir), ca.Key); err != nil {
+		return nil, err
+	}
+	if err := writeFile(certFile, encodeCertificate(ca.Cert), 0644); err != nil {
+		return nil, err
+	}
+	logrus.WithField("notAfter", ca.Cert.NotAfter.Format(time.RFC3339)).Infof("Created CA in %s", filepath.Join(dir, caDir))
+	return ca, nil
+}
+
+// issue issues a certificate with a new private key into a directory, unless the directory already contains a certificate
+func issue(ca *Authority, certDir string, template *x509.Certificate, validity time.Duration) error {
+	if _, err := os.Stat(filepath.Join(certDir, CertFile)); err == nil {
+		logrus.Infof("Skipping %s, which already contains a certificate", certDir)
+		return nil
+	}
+	key, err := newKey()
+	if err != nil {
+		return err
+	}
+	cert, err := ca.Issue(template, key.Public(), validity)
+	if err != nil {
+		return err
+	}
+	if err := writeKey(certDir, key); err != nil {
+		return err
+	}
+	return writeCertificate(certDir, ca, cert)
+}
+
+// writeCertificate writes a certificate along with the certificate of the CA that issued it
+func writeCertificate(certDir string, ca *Authority, cert *x509.Certificate) error {
+	if err := writeFile(filepath.Join(certDir, CaCertFile), encodeCertificate(ca.Cert), 0644); err != nil {
+		return err
+	}
+	if err := writeFile(filepath.Join(certDir, CertFile), encodeCertificate(cert), 0644); err != nil {
+		return err
+	}
+	logrus.WithField("serial", cert.SerialNumber.Text(16)).
+		WithField("notAfter", cert.NotAfter.Format(time.RFC3339)).
+		Infof("Wrote certificate for %s to %s", cert.Subject.CommonName, certDir)
+	return nil
+}
+
+func writeKey(dir string, key crypto.Signer) error {
+	keyBytes, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(dir, KeyFile), keyBytes, 0600)
+}
+
+// writeFile replaces a file by renaming a temporary file over it, so that components watching the file never read it partially written
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,222 @@
+package config
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// KindServing, KindClient, KindCA and KindPeer are the kinds of certificates whose expiry is tracked: certificates served
+	// to clients, certificates presented to servers, certificates in CA bundles and certificates presented by peers
+	KindServing = "serving"
+	KindClient  = "client"
+	KindCA      = "ca"
+	KindPeer    = "peer"
+
+	// expiryCheckInterval is how often tracked certificates are checked against the expiry warning thresholds
+	expiryCheckInterval = time.Hour
+
+	// peerExpiryTTL is how long the certificate of a peer is tracked after it was last presented
+	peerExpiryTTL = 24 * time.Hour
+)
+
+var (
+	// DefaultExpiryWarnings are how long before a certificate expires that warnings are logged
+	DefaultExpiryWarnings = []time.Duration{30 * 24 * time.Hour, 7 * 24 * time.Hour, 24 * time.Hour}
+
+	notAfterGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "portexporter_certificate_not_after_seconds",
+		Help: "The time at which a certificate loaded or seen by portexporter expires, in seconds since the epoch",
+	}, []string{"kind", "source", "subject", "serial"})
+
+	expiry = &expiryTracker{
+		thresholds: DefaultExpiryWarnings,
+		certs:      make(map[expirySource][]*trackedCertificate),
+	}
+)
+
+func init() {
+	prometheus.MustRegister(notAfterGauge)
+}
+
+// CertificateExpiry is the expiry of a certificate loaded or seen by a component
+type CertificateExpiry struct {
+	Kind string `json:"kind"`
+	// Source is the file that a certificate was loaded from or the server name or subject of the peer that presented it
+	Source    string    `json:"source"`
+	Subject   string    `json:"subject"`
+	Serial    string    `json:"serial"`
+	NotAfter  time.Time `json:"notAfter"`
+	ExpiresIn string    `json:"expiresIn"`
+}
+
+type expirySource struct {
+	kind   string
+	source string
+}
+
+type trackedCertificate struct {
+	cert *x509.Certificate
+	// warned is the smallest threshold that a warning has been logged for, or zero if none has
+	warned time.Duration
+	// seen is when the certificate was last loaded or presented
+	seen time.Time
+}
+
+// expiryTracker tracks the expiry of the certificates that the process has loaded or seen, keyed by where they came from
+type expiryTracker struct {
+	lock       sync.Mutex
+	thresholds []time.Duration
+	certs      map[expirySource][]*trackedCertificate
+}
+
+// MonitorExpiry logs a warning whenever a tracked certificate comes within one of the thresholds of its expiry, until the
+// context is done. Certificates are checked against the thresholds as soon as they are tracked and periodically after that
+func MonitorExpiry(ctx context.Context, thresholds []time.Duration) {
+	expiry.lock.Lock()
+	expiry.thresholds = append([]time.Duration{}, thresholds...)
+	sort.Slice(expiry.thresholds, func(i, j int) bool { return expiry.thresholds[i] > expiry.thresholds[j] })
+	expiry.lock.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(expiryCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			expiry.check()
+		}
+	}()
+}
+
+// ParseExpiryWarnings parses durations (e.g. 720h) before the expiry of a certificate that warnings are logged at,
+// returning DefaultExpiryWarnings if none are provided
+func ParseExpiryWarnings(warnings []string) ([]time.Duration, error) {
+	if len(warnings) == 0 {
+		return DefaultExpiryWarnings, nil
+	}
+	var thresholds []time.Duration
+	for _, warning := range warnings {
+		threshold, err := time.ParseDuration(warning)
+		if err != nil || threshold <= 0 {
+			return nil, fmt.Errorf("invalid certificate expiry warning %s: expected a positive duration (e.g. 720h)", warning)
+		}
+		thresholds = append(thresholds, threshold)
+	}
+	return thresholds, nil
+}
+
+// ExpiryStatus returns the expiry of every tracked certificate, soonest first
+func ExpiryStatus() []CertificateExpiry {
+	expiry.lock.Lock()
+	defer expiry.lock.Unlock()
+	var status []CertificateExpiry
+	for source, certs := range expiry.certs {
+		for _, c := range certs {
+			status = append(status, CertificateExpiry{
+				Kind:      source.kind,
+				Source:    source.source,
+				Subject:   c.cert.Subject.String(),
+				Serial:    c.cert.SerialNumber.Text(16),
+				NotAfter:  c.cert.NotAfter,
+				ExpiresIn: time.Until(c.cert.NotAfter).Round(time.Second).String(),
+			})
+		}
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].NotAfter.Before(status[j].NotAfter) })
+	return status
+}
+
+// trackExpiry replaces the certificates tracked for a source, checking the new ones against the expiry warning thresholds
+func trackExpiry(kind, source string, certs ...*x509.Certificate) {
+	expiry.lock.Lock()
+	defer expiry.lock.Unlock()
+	key := expirySource{kind: kind, source: source}
+	previous := make(map[string]*trackedCertificate)
+	for _, c := range expiry.certs[key] {
+		previous[string(c.cert.Raw)] = c
+		deleteGauge(key, c.cert)
+	}
+	var tracked []*trackedCertificate
+	for _, cert := range certs {
+		c, ok := previous[string(cert.Raw)]
+		if !ok {
+			c = &trackedCertificate{cert: cert}
+		}
+		c.seen = time.Now()
+		tracked = append(tracked, c)
+		notAfterGauge.WithLabelValues(kind, source, cert.Subject.String(), cert.SerialNumber.Text(16)).Set(float64(cert.NotAfter.Unix()))
+		expiry.warn(key, c)
+	}
+	expiry.certs[key] = tracked
+}
+
+// check warns about the tracked certificates that have crossed a threshold and stops tracking the certificates of peers
+// that have not been presented within peerExpiryTTL
+func (t *expiryTracker) check() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for source, certs := range t.certs {
+		if source.kind == KindPeer && stale(certs) {
+			for _, c := range certs {
+				deleteGauge(source, c.cert)
+			}
+			delete(t.certs, source)
+			continue
+		}
+		for _, c := range certs {
+			t.warn(source, c)
+		}
+	}
+}
+
+func stale(certs []*trackedCertificate) bool {
+	for _, c := range certs {
+		if time.Since(c.seen) < peerExpiryTTL {
+			return false
+		}
+	}
+	return true
+}
+
+func deleteGauge(source expirySource, cert *x509.Certificate) {
+	notAfterGauge.DeleteLabelValues(source.kind, source.source, cert.Subject.String(), cert.SerialNumber.Text(16))
+}
+
+// warn logs a warning if a certificate has come within a threshold of its expiry that it has not been warned about yet
+func (t *expiryTracker) warn(source expirySource, c *trackedCertificate) {
+	remaining := time.Until(c.cert.NotAfter)
+	logger := logrus.WithField("kind", source.kind).
+		WithField("source", source.source).
+		WithField("serial", c.cert.SerialNumber.Text(16)).
+		WithField("notAfter", c.cert.NotAfter.Format(time.RFC3339))
+	if remaining <= 0 {
+		if c.warned >= 0 {
+			logger.Errorf("Certificate %s has expired", c.cert.Subject)
+			c.warned = -1
+		}
+		return
+	}
+	// thresholds are sorted from largest to smallest, so the last one that was crossed is the smallest
+	var crossed time.Duration
+	for _, threshold := range t.thresholds {
+		if remaining <= threshold {
+			crossed = threshold
+		}
+	}
+	if crossed == 0 || (c.warned != 0 && c.warned <= crossed) {
+		return
+	}
+	c.warned = crossed
+	logger.Warnf("Certificate %s expires in %s", c.cert.Subject, remaining.Round(time.Second))
+}
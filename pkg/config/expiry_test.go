@@ -0,0 +1,127 @@
+package config
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseExpiryWarnings(t *testing.T) {
+	tests := []struct {
+		name     string
+		warnings []string
+		want     []time.Duration
+		wantErr  bool
+	}{
+		{
+			name: "default",
+			want: DefaultExpiryWarnings,
+		},
+		{
+			name:     "durations",
+			warnings: []string{"720h", "1h30m"},
+			want:     []time.Duration{720 * time.Hour, 90 * time.Minute},
+		},
+		{
+			name:     "invalid",
+			warnings: []string{"30d"},
+			wantErr:  true,
+		},
+		{
+			name:     "zero",
+			warnings: []string{"720h", "0s"},
+			wantErr:  true,
+		},
+		{
+			name:     "negative",
+			warnings: []string{"-24h"},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseExpiryWarnings(tt.warnings)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseExpiryWarnings() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseExpiryWarnings() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpiryTrackerWarn(t *testing.T) {
+	const day = 24 * time.Hour
+	tests := []struct {
+		name      string
+		remaining time.Duration
+		warned    time.Duration
+		want      time.Duration
+	}{
+		{
+			name:      "no threshold crossed",
+			remaining: 60 * day,
+		},
+		{
+			name:      "largest threshold crossed",
+			remaining: 20 * day,
+			want:      30 * day,
+		},
+		{
+			name:      "smallest threshold crossed",
+			remaining: 12 * time.Hour,
+			want:      day,
+		},
+		{
+			name:      "already warned",
+			remaining: 20 * day,
+			warned:    30 * day,
+			want:      30 * day,
+		},
+		{
+			name:      "next threshold crossed",
+			remaining: 5 * day,
+			warned:    30 * day,
+			want:      7 * day,
+		},
+		{
+			name:      "warned about smaller threshold",
+			remaining: 5 * day,
+			warned:    day,
+			want:      day,
+		},
+		{
+			name:      "expired",
+			remaining: -time.Hour,
+			warned:    day,
+			want:      -1,
+		},
+		{
+			name:      "already warned about expiry",
+			remaining: -time.Hour,
+			warned:    -1,
+			want:      -1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := &expiryTracker{thresholds: []time.Duration{30 * day, 7 * day, day}}
+			c := &trackedCertificate{
+				cert: &x509.Certificate{
+					Subject:      pkix.Name{CommonName: "test"},
+					SerialNumber: big.NewInt(1),
+					NotAfter:     time.Now().Add(tt.remaining),
+				},
+				warned: tt.warned,
+			}
+			tracker.warn(expirySource{kind: KindServing, source: "test.crt"}, c)
+			if c.warned != tt.want {
+				t.Errorf("warn() warned = %s, want %s", c.warned, tt.want)
+			}
+		})
+	}
+}
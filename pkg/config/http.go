@@ -1,42 +1,205 @@
 package config
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+// HTTP configures how requests are authenticated to an upstream using credentials read from files
 type HTTP struct {
+	// TokenFile is a file containing a bearer token that is sent as the Authorization header
 	TokenFile string `yaml:"tokenFile,omitempty"`
+	// UsernameFile and PasswordFile are files containing a username and password that are sent as the Authorization
+	// header using basic auth
+	UsernameFile string `yaml:"usernameFile,omitempty"`
+	PasswordFile string `yaml:"passwordFile,omitempty"`
+	// Headers are headers that are set to the contents of files (e.g. X-API-Key)
+	Headers []HeaderFile `yaml:"headers,omitempty"`
+	// StripAuthorization removes the Authorization header sent by clients so that it never reaches the upstream
+	StripAuthorization bool `yaml:"stripAuthorization,omitempty"`
 
+	credentials    *credentials
+	reloaded       time.Time
+	credentialLock sync.RWMutex
+}
+
+// HeaderFile is a header that is set to the contents of a file
+type HeaderFile struct {
+	Name string `yaml:"name,omitempty"`
+	File string `yaml:"file,omitempty"`
+}
+
+func (h HeaderFile) String() string {
+	return fmt.Sprintf("%s:%s", h.Name, h.File)
+}
+
+// credentials are the contents of the files of an HTTP configuration
+type credentials struct {
 	token    []byte
-	readOnce sync.Once
+	username []byte
+	password []byte
+	headers  [][]byte
+}
+
+func (c *credentials) equal(other *credentials) bool {
+	if !bytes.Equal(c.token, other.token) || !bytes.Equal(c.username, other.username) || !bytes.Equal(c.password, other.password) {
+		return false
+	}
+	for i := range c.headers {
+		if !bytes.Equal(c.headers[i], other.headers[i]) {
+			return false
+		}
+	}
+	return true
 }
 
-func (h HTTP) String() string {
-	return fmt.Sprintf("[tokenFile=%s]", h.TokenFile)
+func (h *HTTP) String() string {
+	var headers []string
+	for _, header := range h.Headers {
+		headers = append(headers, header.String())
+	}
+	return fmt.Sprintf("[tokenFile=%s,usernameFile=%s,passwordFile=%s,headers=%s,stripAuthorization=%t]", h.TokenFile, h.UsernameFile, h.PasswordFile, strings.Join(headers, ";"), h.StripAuthorization)
+}
+
+// Validate returns an error if the configuration sets the same header in more than one way
+func (h *HTTP) Validate() error {
+	if (h.UsernameFile == "") != (h.PasswordFile == "") {
+		return fmt.Errorf("usernameFile and passwordFile must be provided together")
+	}
+	if h.TokenFile != "" && h.UsernameFile != "" {
+		return fmt.Errorf("tokenFile cannot be provided along with usernameFile and passwordFile")
+	}
+	names := make(map[string]bool)
+	for _, header := range h.Headers {
+		name := http.CanonicalHeaderKey(header.Name)
+		if name == "" || header.File == "" {
+			return fmt.Errorf("header %s must have a name and a file", header)
+		}
+		if names[name] {
+			return fmt.Errorf("header %s is provided more than once", name)
+		}
+		names[name] = true
+		if name == "Authorization" && (h.TokenFile != "" || h.UsernameFile != "") {
+			return fmt.Errorf("header %s cannot be provided along with tokenFile or usernameFile and passwordFile", name)
+		}
+	}
+	return nil
 }
 
 func (h *HTTP) Director(req *http.Request) {
-	if h.TokenFile == "" {
+	if h.StripAuthorization {
+		req.Header.Del("Authorization")
+	}
+	if !h.authenticates() {
 		req.URL.Scheme = "http"
 		return
 	}
-	h.readOnce.Do(h.setToken)
+	// credentials are only ever sent over TLS
 	req.URL.Scheme = "https"
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", h.token))
+	c := h.getCredentials()
+	if h.TokenFile != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.token))
+	}
+	if h.UsernameFile != "" {
+		req.SetBasicAuth(string(c.username), string(c.password))
+	}
+	for i, header := range h.Headers {
+		req.Header.Set(header.Name, string(c.headers[i]))
+	}
 }
 
-func (h *HTTP) setToken() {
+// ReloadCredentials reads the credentials from their files again, returning whether they changed. If any of the files
+// cannot be read, the previous credentials continue to be used
+func (h *HTTP) ReloadCredentials() (bool, error) {
+	if !h.authenticates() {
+		return false, nil
+	}
+	c := &credentials{}
 	var err error
-	h.token, err = ioutil.ReadFile(h.TokenFile)
+	if c.token, err = readCredential(h.TokenFile, "token"); err != nil {
+		return false, err
+	}
+	if c.username, err = readCredential(h.UsernameFile, "username"); err != nil {
+		return false, err
+	}
+	if c.password, err = readCredential(h.PasswordFile, "password"); err != nil {
+		return false, err
+	}
+	for _, header := range h.Headers {
+		value, err := readCredential(header.File, fmt.Sprintf("value for header %s", header.Name))
+		if err != nil {
+			return false, err
+		}
+		c.headers = append(c.headers, value)
+	}
+	h.credentialLock.Lock()
+	defer h.credentialLock.Unlock()
+	changed := h.credentials != nil && !c.equal(h.credentials)
+	h.credentials = c
+	h.reloaded = time.Now()
+	return changed, nil
+}
+
+// CredentialsReloaded returns when the credentials were last read from their files, or the zero time if they have not
+// been read
+func (h *HTTP) CredentialsReloaded() time.Time {
+	h.credentialLock.RLock()
+	defer h.credentialLock.RUnlock()
+	return h.reloaded
+}
+
+// CredentialFiles returns the files that credentials are read from
+func (h *HTTP) CredentialFiles() []string {
+	files := []string{h.TokenFile, h.UsernameFile, h.PasswordFile}
+	for _, header := range h.Headers {
+		files = append(files, header.File)
+	}
+	return files
+}
+
+// authenticates returns whether any credentials are configured
+func (h *HTTP) authenticates() bool {
+	return h.TokenFile != "" || h.UsernameFile != "" || len(h.Headers) > 0
+}
+
+// getCredentials returns the credentials, reading them from their files if they have not been read yet
+func (h *HTTP) getCredentials() *credentials {
+	h.credentialLock.RLock()
+	c := h.credentials
+	h.credentialLock.RUnlock()
+	if c != nil {
+		return c
+	}
+	if _, err := h.ReloadCredentials(); err != nil {
+		logrus.Warn(err)
+	}
+	h.credentialLock.RLock()
+	defer h.credentialLock.RUnlock()
+	if h.credentials == nil {
+		return &credentials{headers: make([][]byte, len(h.Headers))}
+	}
+	return h.credentials
+}
+
+// readCredential returns the contents of a credential file without trailing newlines, or nil if no file is provided
+func readCredential(path, name string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	contents, err := ioutil.ReadFile(path)
 	if err != nil {
-		logrus.Warnf("could not read token from path %s", h.TokenFile)
+		return nil, fmt.Errorf("could not read %s from path %s: %s", name, path, err)
 	}
-	if len(h.token) == 0 {
-		logrus.Warnf("no token found at path %s", h.TokenFile)
+	contents = bytes.TrimRight(contents, "\r\n")
+	if len(contents) == 0 {
+		return nil, fmt.Errorf("no %s found at path %s", name, path)
 	}
+	return contents, nil
 }
@@ -0,0 +1,155 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+const (
+	// PresetModern only allows TLS 1.3
+	PresetModern = "modern"
+	// PresetIntermediate allows TLS 1.2 and TLS 1.3 with forward secret AEAD cipher suites
+	PresetIntermediate = "intermediate"
+)
+
+var (
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+
+	tlsCurves = map[string]tls.CurveID{
+		"X25519": tls.X25519,
+		"P256":   tls.CurveP256,
+		"P384":   tls.CurveP384,
+		"P521":   tls.CurveP521,
+	}
+
+	tlsPresets = map[string]TLSPolicy{
+		PresetModern: {
+			MinVersion: "1.3",
+			Curves:     []string{"X25519", "P256", "P384"},
+		},
+		PresetIntermediate: {
+			MinVersion: "1.2",
+			CipherSuites: []string{
+				"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+				"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+				"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+				"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+				"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+				"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+			},
+			Curves: []string{"X25519", "P256", "P384"},
+		},
+	}
+)
+
+// TLSPolicy restricts the protocol versions and algorithms that can be negotiated over TLS. Fields that are set
+// override the ones of the preset and fields that are left unset in both fall back to the defaults of crypto/tls
+type TLSPolicy struct {
+	// Preset is a named policy to start from (modern or intermediate)
+	Preset string `yaml:"preset,omitempty"`
+	// MinVersion and MaxVersion bound the TLS versions that can be negotiated (1.0, 1.1, 1.2 or 1.3)
+	MinVersion string `yaml:"minVersion,omitempty"`
+	MaxVersion string `yaml:"maxVersion,omitempty"`
+	// CipherSuites are the names of the cipher suites that can be negotiated for TLS 1.2 and below
+	// (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256). TLS 1.3 cipher suites are not configurable
+	CipherSuites []string `yaml:"cipherSuites,omitempty"`
+	// Curves are the elliptic curves that can be used for key exchange, in order of preference (X25519, P256, P384 or P521)
+	Curves []string `yaml:"curves,omitempty"`
+}
+
+// apply restricts a TLS configuration to the policy, returning an error if the policy contains an unknown name
+func (p TLSPolicy) apply(tlsConfig *tls.Config) error {
+	policy, err := p.withPreset()
+	if err != nil {
+		return err
+	}
+	if policy.MinVersion != "" {
+		if tlsConfig.MinVersion, err = parseTLSVersion(policy.MinVersion); err != nil {
+			return err
+		}
+	}
+	if policy.MaxVersion != "" {
+		if tlsConfig.MaxVersion, err = parseTLSVersion(policy.MaxVersion); err != nil {
+			return err
+		}
+	}
+	if tlsConfig.MinVersion != 0 && tlsConfig.MaxVersion != 0 && tlsConfig.MinVersion > tlsConfig.MaxVersion {
+		return fmt.Errorf("invalid TLS policy: min version %s is above max version %s", policy.MinVersion, policy.MaxVersion)
+	}
+	for _, name := range policy.CipherSuites {
+		id, err := parseCipherSuite(name)
+		if err != nil {
+			return err
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+	for _, name := range policy.Curves {
+		curve, ok := tlsCurves[strings.ToUpper(strings.ReplaceAll(name, "-", ""))]
+		if !ok {
+			return fmt.Errorf("unknown curve %s: must be one of X25519, P256, P384, P521", name)
+		}
+		tlsConfig.CurvePreferences = append(tlsConfig.CurvePreferences, curve)
+	}
+	return nil
+}
+
+// withPreset returns the policy with any unset fields filled in from its preset
+func (p TLSPolicy) withPreset() (TLSPolicy, error) {
+	if p.Preset == "" {
+		return p, nil
+	}
+	preset, ok := tlsPresets[strings.ToLower(p.Preset)]
+	if !ok {
+		return p, fmt.Errorf("unknown TLS preset %s: must be one of %s, %s", p.Preset, PresetModern, PresetIntermediate)
+	}
+	if p.MinVersion == "" {
+		p.MinVersion = preset.MinVersion
+	}
+	if p.MaxVersion == "" {
+		p.MaxVersion = preset.MaxVersion
+	}
+	if len(p.CipherSuites) == 0 {
+		p.CipherSuites = preset.CipherSuites
+	}
+	if len(p.Curves) == 0 {
+		p.Curves = preset.Curves
+	}
+	return p, nil
+}
+
+// parseTLSVersion parses a TLS version of the form 1.2, optionally prefixed with TLS (e.g. TLS1.2)
+func parseTLSVersion(version string) (uint16, error) {
+	v, ok := tlsVersions[strings.TrimPrefix(strings.ToUpper(version), "TLS")]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %s: must be one of 1.0, 1.1, 1.2, 1.3", version)
+	}
+	return v, nil
+}
+
+func parseCipherSuite(name string) (uint16, error) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name != name {
+			continue
+		}
+		if len(suite.SupportedVersions) == 1 && suite.SupportedVersions[0] == tls.VersionTLS13 {
+			return 0, fmt.Errorf("cipher suite %s is only used by TLS 1.3, whose cipher suites are not configurable", name)
+		}
+		return suite.ID, nil
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		if suite.Name == name {
+			return 0, fmt.Errorf("cipher suite %s is insecure and cannot be used", name)
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher suite %s", name)
+}
+
+func (p TLSPolicy) String() string {
+	return fmt.Sprintf("[preset=%s,minVersion=%s,maxVersion=%s,cipherSuites=%s,curves=%s]", p.Preset, p.MinVersion, p.MaxVersion, strings.Join(p.CipherSuites, ";"), strings.Join(p.Curves, ";"))
+}
@@ -0,0 +1,161 @@
+package config
+
+import (
+	"crypto/tls"
+	"reflect"
+	"testing"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    uint16
+		wantErr bool
+	}{
+		{version: "1.0", want: tls.VersionTLS10},
+		{version: "1.1", want: tls.VersionTLS11},
+		{version: "1.2", want: tls.VersionTLS12},
+		{version: "1.3", want: tls.VersionTLS13},
+		{version: "TLS1.2", want: tls.VersionTLS12},
+		{version: "tls1.3", want: tls.VersionTLS13},
+		{version: "1.4", wantErr: true},
+		{version: "", wantErr: true},
+		{version: "SSL3.0", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTLSVersion(tt.version)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTLSVersion(%q) error = %v, wantErr %v", tt.version, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseTLSVersion(%q) = %x, want %x", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestParseCipherSuite(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    uint16
+		wantErr bool
+	}{
+		{name: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", want: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		{name: "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256", want: tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256},
+		// TLS 1.3 suites are not configurable
+		{name: "TLS_AES_128_GCM_SHA256", wantErr: true},
+		// insecure suites are refused
+		{name: "TLS_RSA_WITH_RC4_128_SHA", wantErr: true},
+		{name: "TLS_UNKNOWN", wantErr: true},
+		{name: "tls_ecdhe_rsa_with_aes_128_gcm_sha256", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseCipherSuite(tt.name)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCipherSuite(%q) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseCipherSuite(%q) = %x, want %x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTLSPolicyApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  TLSPolicy
+		want    *tls.Config
+		wantErr bool
+	}{
+		{
+			name: "empty",
+			want: &tls.Config{},
+		},
+		{
+			name:   "versions",
+			policy: TLSPolicy{MinVersion: "1.2", MaxVersion: "1.3"},
+			want:   &tls.Config{MinVersion: tls.VersionTLS12, MaxVersion: tls.VersionTLS13},
+		},
+		{
+			name:    "min above max",
+			policy:  TLSPolicy{MinVersion: "1.3", MaxVersion: "1.2"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown version",
+			policy:  TLSPolicy{MinVersion: "2.0"},
+			wantErr: true,
+		},
+		{
+			name:   "curves",
+			policy: TLSPolicy{Curves: []string{"x25519", "P-256", "p521"}},
+			want:   &tls.Config{CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP521}},
+		},
+		{
+			name:    "unknown curve",
+			policy:  TLSPolicy{Curves: []string{"P224"}},
+			wantErr: true,
+		},
+		{
+			name:   "cipher suites",
+			policy: TLSPolicy{CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}},
+			want:   &tls.Config{CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}},
+		},
+		{
+			name:    "unknown cipher suite",
+			policy:  TLSPolicy{CipherSuites: []string{"TLS_UNKNOWN"}},
+			wantErr: true,
+		},
+		{
+			name:   "modern preset",
+			policy: TLSPolicy{Preset: "Modern"},
+			want: &tls.Config{
+				MinVersion:       tls.VersionTLS13,
+				CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+			},
+		},
+		{
+			name:   "preset with overrides",
+			policy: TLSPolicy{Preset: PresetIntermediate, MinVersion: "1.3", Curves: []string{"P384"}},
+			want: &tls.Config{
+				MinVersion: tls.VersionTLS13,
+				CipherSuites: []uint16{
+					tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+					tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+					tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+					tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+					tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+					tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+				},
+				CurvePreferences: []tls.CurveID{tls.CurveP384},
+			},
+		},
+		{
+			name:    "unknown preset",
+			policy:  TLSPolicy{Preset: "old"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got tls.Config
+			err := tt.policy.apply(&got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("apply() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.MinVersion != tt.want.MinVersion || got.MaxVersion != tt.want.MaxVersion {
+				t.Errorf("apply() versions = %x-%x, want %x-%x", got.MinVersion, got.MaxVersion, tt.want.MinVersion, tt.want.MaxVersion)
+			}
+			if !reflect.DeepEqual(got.CipherSuites, tt.want.CipherSuites) {
+				t.Errorf("apply() cipher suites = %v, want %v", got.CipherSuites, tt.want.CipherSuites)
+			}
+			if !reflect.DeepEqual(got.CurvePreferences, tt.want.CurvePreferences) {
+				t.Errorf("apply() curves = %v, want %v", got.CurvePreferences, tt.want.CurvePreferences)
+			}
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/aiyengar2/portexporter/pkg/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// certReloader serves the key pairs, client CA bundle and revocation lists of a TLSServer, reloading them whenever their files change.
+// Connections that have already completed a handshake keep using the certificate they were established with, unless they
+// were accepted by a tracked listener and authenticated with a client certificate that is revoked
+type certReloader struct {
+	TLSServer
+
+	lock sync.RWMutex
+	// cert is the default certificate and sniCerts are the certificates chosen by server name, in the order they were configured
+	cert       *tls.Certificate
+	sniCerts   []*tls.Certificate
+	caCert     []byte
+	clientCAs  *x509.CertPool
+	revocation *revocationList
+
+	watcher   *utils.FileWatcher
+	stopWatch func()
+
+	// conns maps the open connections accepted by a tracked listener to their client certificate, once their handshake completes
+	conns    map[*trackedConn]*x509.Certificate
+	connLock sync.Mutex
+}
+
+func newCertReloader(s TLSServer) (*certReloader, error) {
+	r := &certReloader{
+		TLSServer: s,
+		conns:     make(map[*trackedConn]*x509.Certificate),
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	r.watch()
+	return r, nil
+}
+
+// reload loads the key pairs and client CA bundle, leaving the ones currently in use in place if any fail to load
+func (r *certReloader) reload() error {
+	cert, err := KeyPair{CertFile: r.CertFile, KeyFile: r.KeyFile}.load()
+	if err != nil {
+		return err
+	}
+	var sniCerts []*tls.Certificate
+	for _, pair := range r.SNICertificates {
+		sniCert, err := pair.load()
+		if err != nil {
+			return err
+		}
+		sniCerts = append(sniCerts, sniCert)
+	}
+
+	var caCert []byte
+	var caCerts []*x509.Certificate
+	var clientCAs *x509.CertPool
+	var revocation *revocationList
+	if r.CaCertFile != "" {
+		caCert, clientCAs, err = loadCertPool(r.CaCertFile)
+		if err != nil {
+			return err
+		}
+		caCerts, err = parseCertificates(caCert)
+		if err != nil {
+			return fmt.Errorf("unable to parse cacert file %s: %s", r.CaCertFile, err)
+		}
+		if len(r.CRLFiles) > 0 || r.DenyListFile != "" {
+			revocation, err = loadRevocationList(r.CRLFiles, r.DenyListFile, caCerts)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	logLoaded(r.CertFile, r.cert, cert)
+	for i, sniCert := range sniCerts {
+		var previous *tls.Certificate
+		if i < len(r.sniCerts) {
+			previous = r.sniCerts[i]
+		}
+		logLoaded(r.SNICertificates[i].CertFile, previous, sniCert)
+	}
+	if r.caCert != nil && !bytes.Equal(r.caCert, caCert) {
+		logrus.Infof("Loaded client CA bundle from %s", r.CaCertFile)
+	}
+	if r.CaCertFile != "" {
+		trackExpiry(KindCA, r.CaCertFile, caCerts...)
+	}
+	r.cert = cert
+	r.sniCerts = sniCerts
+	r.caCert = caCert
+	r.clientCAs = clientCAs
+	r.revocation = revocation
+	go r.closeRevoked()
+	return nil
+}
+
+// watch reloads the key pairs, client CA bundle and revocation lists whenever a file in one of their directories
+// changes, until the reloader is closed
+func (r *certReloader) watch() {
+	paths := append([]string{r.CertFile, r.KeyFile, r.CaCertFile, r.DenyListFile}, r.CRLFiles...)
+	for _, pair := range r.SNICertificates {
+		paths = append(paths, pair.CertFile, pair.KeyFile)
+	}
+	r.watcher = utils.NewFileWatcher()
+	r.stopWatch = r.watcher.Watch(paths, 0, func() {
+		if err := r.reload(); err != nil {
+			logrus.Errorf("unable to reload TLS certificate, continuing to serve the previous one: %s", err)
+		}
+	})
+}
+
+// close stops watching the files of the reloader
+func (r *certReloader) close() {
+	r.stopWatch()
+	r.watcher.Close()
+}
+
+// getCertificate returns the first SNI certificate that is valid for the server name requested by the client,
+// falling back to the default certificate if there is none or the client did not request a server name
+func (r *certReloader) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if hello.ServerName != "" {
+		for _, cert := range r.sniCerts {
+			if cert.Leaf.VerifyHostname(hello.ServerName) == nil {
+				return cert, nil
+			}
+		}
+	}
+	return r.cert, nil
+}
+
+// configForClient returns a copy of the provided config that verifies client certificates against the current client CA bundle
+// and revocation lists. The client certificate of a tracked connection is recorded once its handshake completes
+func (r *certReloader) configForClient(tlsConfig *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		r.lock.RLock()
+		defer r.lock.RUnlock()
+		clientConfig := tlsConfig.Clone()
+		clientConfig.GetConfigForClient = nil
+		clientConfig.ClientCAs = r.clientCAs
+		clientConfig.VerifyPeerCertificate = r.verifyNotRevoked
+		clientConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return nil
+			}
+			peer := state.PeerCertificates[0]
+			trackExpiry(KindPeer, peer.Subject.CommonName, peer)
+			if conn, ok := hello.Conn.(*trackedConn); ok {
+				r.setPeer(conn, peer)
+			}
+			return nil
+		}
+		return clientConfig, nil
+	}
+}
+
+// verifyNotRevoked returns an error if any certificate in the verified chains of a client, other than a root, is revoked
+func (r *certReloader) verifyNotRevoked(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for _, chain := range verifiedChains {
+		for i, cert := range chain {
+			if i > 0 && i == len(chain)-1 {
+				break
+			}
+			if source, ok := r.revocation.revoked(cert); ok {
+				return fmt.Errorf("certificate %s with serial %s is revoked by %s", cert.Subject, cert.SerialNumber.Text(16), source)
+			}
+		}
+	}
+	return nil
+}
+
+// track returns a connection whose client certificate is tracked until it is closed
+func (r *certReloader) track(conn net.Conn) net.Conn {
+	c := &trackedConn{Conn: conn, reloader: r}
+	r.connLock.Lock()
+	defer r.connLock.Unlock()
+	r.conns[c] = nil
+	return c
+}
+
+func (r *certReloader) untrack(c *trackedConn) {
+	r.connLock.Lock()
+	defer r.connLock.Unlock()
+	delete(r.conns, c)
+}
+
+func (r *certReloader) setPeer(c *trackedConn, cert *x509.Certificate) {
+	r.connLock.Lock()
+	defer r.connLock.Unlock()
+	if _, ok := r.conns[c]; ok {
+		r.conns[c] = cert
+	}
+}
+
+// closeRevoked closes the tracked connections that were authenticated with a client certificate that is now revoked
+func (r *certReloader) closeRevoked() {
+	r.lock.RLock()
+	revocation := r.revocation
+	r.lock.RUnlock()
+
+	var revoked []*trackedConn
+	r.connLock.Lock()
+	for c, cert := range r.conns {
+		if cert == nil {
+			continue
+		}
+		if source, ok := revocation.revoked(cert); ok {
+			logrus.WithField("remoteAddr", c.RemoteAddr().String()).
+				WithField("serial", cert.SerialNumber.Text(16)).
+				Warnf("Closing connection authenticated with certificate %s, which is revoked by %s", cert.Subject, source)
+			revoked = append(revoked, c)
+		}
+	}
+	r.connLock.Unlock()
+	for _, c := range revoked {
+		c.Close()
+	}
+}
+
+// load loads the key pair, parsing its leaf certificate so that it can be matched against server names
+func (p KeyPair) load() (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load X.509 certificate from cert file %s and key file %s: %s", p.CertFile, p.KeyFile, err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse X.509 certificate from cert file %s: %s", p.CertFile, err)
+	}
+	return &cert, nil
+}
+
+// logLoaded logs the serial and expiry of a certificate that was loaded from a file, unless it was already being served
+func logLoaded(certFile string, previous, cert *tls.Certificate) {
+	trackExpiry(KindServing, certFile, cert.Leaf)
+	if previous != nil && bytes.Equal(previous.Certificate[0], cert.Certificate[0]) {
+		return
+	}
+	logrus.WithField("serial", cert.Leaf.SerialNumber.Text(16)).
+		WithField("notAfter", cert.Leaf.NotAfter.Format(time.RFC3339)).
+		Infof("Loaded TLS certificate from %s", certFile)
+}
+
+// loadCertPool returns the contents of a PEM encoded CA bundle and a pool containing its certificates
+func loadCertPool(caCertFile string) ([]byte, *x509.CertPool, error) {
+	caCert, err := ioutil.ReadFile(caCertFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read cacert file %s: %s", caCertFile, err)
+	}
+	caCertPool := x509.NewCertPool()
+	if ok := caCertPool.AppendCertsFromPEM(caCert); !ok {
+		return nil, nil, fmt.Errorf("failed to use cacert file %s as ca certificate", caCertFile)
+	}
+	return caCert, caCertPool, nil
+}
@@ -0,0 +1,169 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+)
+
+// revocationList is the set of client certificates that a server rejects even though they were issued by a trusted CA
+type revocationList struct {
+	// serials and fingerprints map lowercase hex encoded serial numbers and SHA-256 fingerprints to the file that revoked them
+	serials      map[string]string
+	fingerprints map[string]string
+}
+
+// loadRevocationList loads the serial numbers of the certificates revoked by CRL files, each of which must be signed by one
+// of the CA certificates, and the serial numbers and fingerprints of the certificates listed in a deny list
+func loadRevocationList(crlFiles []string, denyListFile string, caCerts []*x509.Certificate) (*revocationList, error) {
+	l := &revocationList{
+		serials:      make(map[string]string),
+		fingerprints: make(map[string]string),
+	}
+	for _, crlFile := range crlFiles {
+		if err := l.loadCRL(crlFile, caCerts); err != nil {
+			return nil, err
+		}
+	}
+	if denyListFile != "" {
+		if err := l.loadDenyList(denyListFile); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (l *revocationList) loadCRL(crlFile string, caCerts []*x509.Certificate) error {
+	crlBytes, err := ioutil.ReadFile(crlFile)
+	if err != nil {
+		return fmt.Errorf("unable to read crl file %s: %s", crlFile, err)
+	}
+	crl, err := x509.ParseCRL(crlBytes)
+	if err != nil {
+		return fmt.Errorf("unable to parse crl file %s: %s", crlFile, err)
+	}
+	signed := false
+	for _, caCert := range caCerts {
+		if caCert.CheckCRLSignature(crl) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return fmt.Errorf("crl file %s is not signed by a certificate in the cacert file", crlFile)
+	}
+	for _, revoked := range crl.TBSCertList.RevokedCertificates {
+		l.serials[revoked.SerialNumber.Text(16)] = crlFile
+	}
+	return nil
+}
+
+// loadDenyList loads a file containing one certificate serial number or SHA-256 fingerprint per line, hex encoded with
+// optional colons. The output of openssl x509 -serial or -fingerprint -sha256 can be used as is. Lines starting with # are ignored
+func (l *revocationList) loadDenyList(denyListFile string) error {
+	denyList, err := ioutil.ReadFile(denyListFile)
+	if err != nil {
+		return fmt.Errorf("unable to read deny list file %s: %s", denyListFile, err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(denyList))
+	for scanner.Scan() {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		// drop the field name printed by openssl (e.g. serial=... or SHA256 Fingerprint=...)
+		if i := strings.LastIndex(entry, "="); i >= 0 {
+			entry = entry[i+1:]
+		}
+		entry = strings.ToLower(strings.TrimPrefix(strings.ReplaceAll(entry, ":", ""), "0x"))
+		if _, err := hex.DecodeString(strings.Repeat("0", len(entry)%2) + entry); err != nil || entry == "" {
+			return fmt.Errorf("invalid entry %s in deny list file %s: expected a hex encoded serial number or SHA-256 fingerprint", scanner.Text(), denyListFile)
+		}
+		if len(entry) == 2*sha256.Size {
+			l.fingerprints[entry] = denyListFile
+			continue
+		}
+		serial := strings.TrimLeft(entry, "0")
+		if serial == "" {
+			serial = "0"
+		}
+		l.serials[serial] = denyListFile
+	}
+	return scanner.Err()
+}
+
+// revoked returns whether a certificate is revoked and the file that revoked it
+func (l *revocationList) revoked(cert *x509.Certificate) (string, bool) {
+	if l == nil {
+		return "", false
+	}
+	if source, ok := l.serials[cert.SerialNumber.Text(16)]; ok {
+		return source, true
+	}
+	fingerprint := sha256.Sum256(cert.Raw)
+	source, ok := l.fingerprints[hex.EncodeToString(fingerprint[:])]
+	return source, ok
+}
+
+// parseCertificates parses the certificates in a PEM encoded bundle
+func parseCertificates(pemBytes []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, pemBytes = pem.Decode(pemBytes)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+}
+
+// trackedListener registers the connections it accepts with a certReloader so that they can be closed if their client
+// certificate is revoked
+type trackedListener struct {
+	net.Listener
+	reloader *certReloader
+}
+
+func (l *trackedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.reloader.track(conn), nil
+}
+
+// Close stops the listener along with the reloading of its certificates
+func (l *trackedListener) Close() error {
+	l.reloader.close()
+	return l.Listener.Close()
+}
+
+// trackedConn is a connection whose client certificate is tracked by a certReloader until it is closed
+type trackedConn struct {
+	net.Conn
+	reloader  *certReloader
+	closeOnce sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.reloader.untrack(c)
+	})
+	return c.Conn.Close()
+}
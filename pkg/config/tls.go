@@ -1,10 +1,14 @@
 package config
 
 import (
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"fmt"
-	"io/ioutil"
+	"net"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 )
@@ -13,84 +17,268 @@ type TLSServer struct {
 	CertFile   string `yaml:"certFile,omitempty"`
 	KeyFile    string `yaml:"keyFile,omitempty"`
 	CaCertFile string `yaml:"caCertFile,omitempty"`
+	// SNICertificates are served instead of the certificate in CertFile to clients that request a server name that one of them
+	// is valid for. The first certificate whose DNS names or IP addresses match is served
+	SNICertificates []KeyPair `yaml:"sniCertificates,omitempty"`
+	// CRLFiles are certificate revocation lists, signed by a CA in CaCertFile, of client certificates to reject
+	CRLFiles []string `yaml:"crlFiles,omitempty"`
+	// DenyListFile is a file listing the serial numbers or SHA-256 fingerprints of client certificates to reject, one per line
+	DenyListFile string `yaml:"denyListFile,omitempty"`
+	// Strict rejects partial configurations, such as a cacert file without a cert file and key file, instead of ignoring them
+	Strict bool `yaml:"strict,omitempty"`
+	// Policy restricts the TLS versions and algorithms that clients can negotiate
+	Policy TLSPolicy `yaml:"policy,omitempty"`
 }
 
-func (s TLSServer) TLSConfig(address string) *tls.Config {
-	tlsConfig := &tls.Config{
-		ServerName: address,
+// TLSConfig returns a configuration that serves TLS with the configured files, reloading them when they change until
+// the context is done
+func (s TLSServer) TLSConfig(ctx context.Context) (*tls.Config, error) {
+	tlsConfig, reloader, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	if reloader != nil {
+		go func() {
+			<-ctx.Done()
+			reloader.close()
+		}()
+	}
+	return tlsConfig, nil
+}
+
+// Listen listens for connections on the address, serving TLS over them if a cert file and key file are configured.
+// Unlike connections served with the configuration returned by TLSConfig, connections authenticated with a client
+// certificate are closed as soon as a revocation of that certificate is loaded. Files are reloaded until the listener
+// is closed
+func (s TLSServer) Listen(address string) (net.Listener, error) {
+	tlsConfig, reloader, err := s.load()
+	if err != nil {
+		return nil, err
 	}
-	err := s.loadConfig(tlsConfig)
+	l, err := net.Listen("tcp", address)
 	if err != nil {
-		logrus.Error(err)
+		return nil, err
+	}
+	if reloader == nil {
+		return l, nil
 	}
-	return tlsConfig
+	return tls.NewListener(&trackedListener{Listener: l, reloader: reloader}, tlsConfig), nil
 }
 
-func (s TLSServer) loadConfig(tlsConfig *tls.Config) error {
-	if s.CertFile == "" || s.KeyFile == "" {
-		return nil
+// Enabled returns whether a cert file and key file are configured, in which case connections are served over TLS
+func (s TLSServer) Enabled() bool {
+	return s.CertFile != "" && s.KeyFile != ""
+}
+
+func (s TLSServer) load() (*tls.Config, *certReloader, error) {
+	tlsConfig := &tls.Config{}
+	if err := s.Policy.apply(tlsConfig); err != nil {
+		return nil, nil, err
 	}
-	cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+	reloader, err := s.loadConfig(tlsConfig)
 	if err != nil {
-		return fmt.Errorf("unable to load X.509 certificate from cert file %s and key file %s: %s", s.CertFile, s.KeyFile, err)
+		return nil, nil, err
 	}
-	tlsConfig.Certificates = []tls.Certificate{cert}
+	return tlsConfig, reloader, nil
+}
 
-	if s.CaCertFile == "" {
-		return nil
+// loadConfig serves the key pair through GetCertificate so that it can be reloaded without restarting the server
+func (s TLSServer) loadConfig(tlsConfig *tls.Config) (*certReloader, error) {
+	if !s.Enabled() {
+		return nil, s.checkPartialConfig()
+	}
+	if s.CaCertFile == "" && (len(s.CRLFiles) > 0 || s.DenyListFile != "") {
+		err := fmt.Errorf("revocation lists were provided without a cacert file, so client certificates are not requested")
+		if s.Strict {
+			return nil, err
+		}
+		logrus.Warnf("ignoring TLS configuration: %s", err)
 	}
-	caCert, err := ioutil.ReadFile(s.CaCertFile)
+	reloader, err := newCertReloader(s)
 	if err != nil {
-		return fmt.Errorf("unable to read cacert file %s: %s", s.CaCertFile, err)
+		return nil, err
 	}
-	caCertPool := x509.NewCertPool()
-	if ok := caCertPool.AppendCertsFromPEM(caCert); !ok {
-		return fmt.Errorf("failed to use cacert file %s as ca certificate", s.CaCertFile)
+	tlsConfig.GetCertificate = reloader.getCertificate
+	if s.CaCertFile == "" {
+		return reloader, nil
 	}
-	tlsConfig.ClientCAs = caCertPool
 	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	tlsConfig.GetConfigForClient = reloader.configForClient(tlsConfig)
+
+	return reloader, nil
+}
 
+// checkPartialConfig returns an error in strict mode if TLS files were provided without both a cert file and key file.
+// Otherwise, the files are ignored with a warning since connections will not be encrypted or authenticated
+func (s TLSServer) checkPartialConfig() error {
+	var err error
+	switch {
+	case s.CertFile != "" && s.KeyFile == "":
+		err = fmt.Errorf("cert file %s was provided without a key file", s.CertFile)
+	case s.KeyFile != "" && s.CertFile == "":
+		err = fmt.Errorf("key file %s was provided without a cert file", s.KeyFile)
+	case s.CaCertFile != "":
+		err = fmt.Errorf("cacert file %s was provided without a cert file and key file, so client certificates cannot be verified", s.CaCertFile)
+	case len(s.SNICertificates) > 0:
+		err = fmt.Errorf("SNI certificates were provided without a default cert file and key file")
+	case len(s.CRLFiles) > 0 || s.DenyListFile != "":
+		err = fmt.Errorf("revocation lists were provided without a cert file and key file, so client certificates are not requested")
+	default:
+		return nil
+	}
+	if s.Strict {
+		return err
+	}
+	logrus.Warnf("ignoring TLS configuration: %s", err)
 	return nil
 }
 
+// KeyPair is a certificate and the private key that it was issued for
+type KeyPair struct {
+	CertFile string `yaml:"certFile,omitempty"`
+	KeyFile  string `yaml:"keyFile,omitempty"`
+}
+
+// ParseKeyPair parses a key pair of the form CERT_FILE,KEY_FILE
+func ParseKeyPair(keyPair string) (KeyPair, error) {
+	parts := strings.SplitN(keyPair, ",", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return KeyPair{}, fmt.Errorf("invalid key pair %s: expected CERT_FILE,KEY_FILE", keyPair)
+	}
+	return KeyPair{CertFile: parts[0], KeyFile: parts[1]}, nil
+}
+
+func (p KeyPair) String() string {
+	return fmt.Sprintf("[certFile=%s,keyFile=%s]", p.CertFile, p.KeyFile)
+}
+
 func (s TLSServer) String() string {
-	return fmt.Sprintf("[certFile=%s,keyFile=%s]", s.CertFile, s.KeyFile)
+	return fmt.Sprintf("[certFile=%s,keyFile=%s,caCertFile=%s,sniCertificates=%s,crlFiles=%s,denyListFile=%s,strict=%t,policy=%s]", s.CertFile, s.KeyFile, s.CaCertFile, s.SNICertificates, strings.Join(s.CRLFiles, ";"), s.DenyListFile, s.Strict, s.Policy)
 }
 
 type TLSClient struct {
 	InsecureSkipVerify bool   `yaml:"insecureSkipVerify,omitempty"`
 	CaCertFile         string `yaml:"caCertFile,omitempty"`
+	// CertFile and KeyFile are a client certificate and key presented to servers that request one, read on every handshake
+	CertFile string `yaml:"certFile,omitempty"`
+	KeyFile  string `yaml:"keyFile,omitempty"`
+	// PinnedSHA256 are base64 encoded SHA-256 hashes of subject public key infos (SPKI), one of which must belong
+	// to a certificate in the verified chain, or to the server's own certificate if verification is skipped.
+	// Multiple pins can be provided to allow for key rotation
+	PinnedSHA256 []string `yaml:"pinnedSHA256,omitempty"`
+	// Policy restricts the TLS versions and algorithms that can be negotiated with servers
+	Policy TLSPolicy `yaml:"policy,omitempty"`
 }
 
-func (c TLSClient) TLSConfig(address string) *tls.Config {
+// TLSConfig returns the configuration for connecting to a server, verifying the server's certificate against the
+// provided server name (a hostname or IP address, without a scheme or port)
+func (c TLSClient) TLSConfig(serverName string) (*tls.Config, error) {
 	tlsConfig := &tls.Config{
-		ServerName: address,
+		ServerName: serverName,
 	}
-	err := c.loadConfig(tlsConfig)
-	if err != nil {
-		logrus.Error(err)
+	if err := c.Policy.apply(tlsConfig); err != nil {
+		return nil, err
+	}
+	if err := c.loadConfig(tlsConfig); err != nil {
+		return nil, err
 	}
-	return tlsConfig
+	return tlsConfig, nil
 }
 
 func (c TLSClient) loadConfig(tlsConfig *tls.Config) error {
 	tlsConfig.InsecureSkipVerify = c.InsecureSkipVerify
+	if len(c.PinnedSHA256) > 0 {
+		verifyPins, err := c.pinVerifier(tlsConfig.ServerName)
+		if err != nil {
+			return err
+		}
+		tlsConfig.VerifyPeerCertificate = verifyPins
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		clientCert := KeyPair{CertFile: c.CertFile, KeyFile: c.KeyFile}
+		if c.CertFile == "" || c.KeyFile == "" {
+			return fmt.Errorf("client certificate %s requires both a cert file and key file", clientCert)
+		}
+		cert, err := clientCert.load()
+		if err != nil {
+			return err
+		}
+		trackExpiry(KindClient, c.CertFile, cert.Leaf)
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := clientCert.load()
+			if err != nil {
+				return nil, err
+			}
+			trackExpiry(KindClient, c.CertFile, cert.Leaf)
+			return cert, nil
+		}
+	}
+	serverName := tlsConfig.ServerName
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) > 0 {
+			trackExpiry(KindPeer, serverName, state.PeerCertificates[0])
+		}
+		return nil
+	}
 	if c.CaCertFile == "" {
 		return nil
 	}
-	caCert, err := ioutil.ReadFile(c.CaCertFile)
+	caCert, caCertPool, err := loadCertPool(c.CaCertFile)
 	if err != nil {
-		return fmt.Errorf("unable to read cacert file %s: %s", c.CaCertFile, err)
+		return err
 	}
-	caCertPool := x509.NewCertPool()
-	if ok := caCertPool.AppendCertsFromPEM(caCert); !ok {
-		return fmt.Errorf("failed to use cacert file %s as ca certificate", c.CaCertFile)
+	caCerts, err := parseCertificates(caCert)
+	if err != nil {
+		return fmt.Errorf("unable to parse cacert file %s: %s", c.CaCertFile, err)
 	}
+	trackExpiry(KindCA, c.CaCertFile, caCerts...)
 	tlsConfig.RootCAs = caCertPool
 
 	return nil
 }
 
+// pinVerifier returns a function that verifies that one of the certificates presented by a server matches a pin
+func (c TLSClient) pinVerifier(address string) (func([][]byte, [][]*x509.Certificate) error, error) {
+	pins := make(map[string]bool)
+	for _, pin := range c.PinnedSHA256 {
+		pin = strings.TrimPrefix(pin, "sha256/")
+		hash, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid certificate pin %s: expected a base64 encoded SHA-256 hash", pin)
+		}
+		pins[pin] = true
+	}
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		var certs []*x509.Certificate
+		for _, chain := range verifiedChains {
+			certs = append(certs, chain...)
+		}
+		if len(verifiedChains) == 0 && len(rawCerts) > 0 {
+			// verification was skipped, so only the leaf can be trusted since the server proved it holds its key
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			certs = append(certs, cert)
+		}
+		var presented []string
+		for _, cert := range certs {
+			pin := SPKIHash(cert)
+			if pins[pin] {
+				return nil
+			}
+			presented = append(presented, pin)
+		}
+		return fmt.Errorf("certificate pin mismatch for %s: none of the presented certificates [%s] match a pinned SPKI SHA-256 hash", address, strings.Join(presented, ", "))
+	}, nil
+}
+
+// SPKIHash returns the base64 encoded SHA-256 hash of the subject public key info of a certificate
+func SPKIHash(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
 func (c TLSClient) String() string {
-	return fmt.Sprintf("[insecureSkipVerify=%t,caCertFile=%s]", c.InsecureSkipVerify, c.CaCertFile)
+	return fmt.Sprintf("[insecureSkipVerify=%t,caCertFile=%s,certFile=%s,keyFile=%s,pinnedSHA256=%s,policy=%s]", c.InsecureSkipVerify, c.CaCertFile, c.CertFile, c.KeyFile, strings.Join(c.PinnedSHA256, ";"), c.Policy)
 }
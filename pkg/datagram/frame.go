@@ -0,0 +1,58 @@
+package datagram
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// MaxSize is the largest datagram that can be framed
+	MaxSize = 65535
+
+	headerSize = 2
+)
+
+// WriteFrame writes a datagram to a stream, prefixed by its length so that its boundaries are preserved
+func WriteFrame(w io.Writer, datagram []byte) error {
+	if len(datagram) > MaxSize {
+		return fmt.Errorf("datagram of %d bytes exceeds maximum size of %d bytes", len(datagram), MaxSize)
+	}
+	frame := make([]byte, headerSize+len(datagram))
+	binary.BigEndian.PutUint16(frame, uint16(len(datagram)))
+	copy(frame[headerSize:], datagram)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadFrame reads a single datagram written by WriteFrame from a stream into buf, which must be able to hold MaxSize bytes
+func ReadFrame(r io.Reader, buf []byte) (int, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint16(header[:]))
+	if size > len(buf) {
+		return 0, fmt.Errorf("datagram of %d bytes does not fit in buffer of %d bytes", size, len(buf))
+	}
+	if _, err := io.ReadFull(r, buf[:size]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	return size, nil
+}
+
+// NextFrame splits the first complete frame off of buf, returning the datagram it holds and the remaining bytes.
+// If buf does not yet hold a complete frame, ok is false
+func NextFrame(buf []byte) (datagram []byte, rest []byte, ok bool) {
+	if len(buf) < headerSize {
+		return nil, buf, false
+	}
+	size := int(binary.BigEndian.Uint16(buf))
+	if len(buf) < headerSize+size {
+		return nil, buf, false
+	}
+	return buf[headerSize : headerSize+size], buf[headerSize+size:], true
+}
@@ -0,0 +1,173 @@
+package datagram
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	datagrams := [][]byte{
+		[]byte("metric:1|c"),
+		{},
+		bytes.Repeat([]byte{0xff}, 1024),
+		bytes.Repeat([]byte{0x01}, MaxSize),
+	}
+	var stream bytes.Buffer
+	for _, d := range datagrams {
+		if err := WriteFrame(&stream, d); err != nil {
+			t.Fatalf("WriteFrame() of %d bytes failed: %s", len(d), err)
+		}
+	}
+	buf := make([]byte, MaxSize)
+	for _, want := range datagrams {
+		n, err := ReadFrame(&stream, buf)
+		if err != nil {
+			t.Fatalf("ReadFrame() failed: %s", err)
+		}
+		if !bytes.Equal(buf[:n], want) {
+			t.Errorf("ReadFrame() = %d bytes, want %d bytes", n, len(want))
+		}
+	}
+	if _, err := ReadFrame(&stream, buf); err != io.EOF {
+		t.Errorf("ReadFrame() at end of stream error = %v, want %v", err, io.EOF)
+	}
+}
+
+func TestWriteFrameTooLarge(t *testing.T) {
+	var stream bytes.Buffer
+	if err := WriteFrame(&stream, make([]byte, MaxSize+1)); err == nil {
+		t.Error("WriteFrame() of an oversized datagram succeeded")
+	}
+	if stream.Len() != 0 {
+		t.Errorf("WriteFrame() of an oversized datagram wrote %d bytes", stream.Len())
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		stream  []byte
+		bufSize int
+		want    []byte
+		wantErr error
+	}{
+		{
+			name:    "complete",
+			stream:  []byte{0, 3, 'a', 'b', 'c'},
+			bufSize: MaxSize,
+			want:    []byte("abc"),
+		},
+		{
+			name:    "empty stream",
+			bufSize: MaxSize,
+			wantErr: io.EOF,
+		},
+		{
+			name:    "partial header",
+			stream:  []byte{0},
+			bufSize: MaxSize,
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "missing payload",
+			stream:  []byte{0, 3},
+			bufSize: MaxSize,
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "partial payload",
+			stream:  []byte{0, 3, 'a'},
+			bufSize: MaxSize,
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "buffer too small",
+			stream:  []byte{0, 3, 'a', 'b', 'c'},
+			bufSize: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := make([]byte, tt.bufSize)
+			n, err := ReadFrame(bytes.NewReader(tt.stream), buf)
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("ReadFrame() succeeded, want error")
+				}
+				if tt.wantErr != nil && err != tt.wantErr {
+					t.Errorf("ReadFrame() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadFrame() failed: %s", err)
+			}
+			if !bytes.Equal(buf[:n], tt.want) {
+				t.Errorf("ReadFrame() = %q, want %q", buf[:n], tt.want)
+			}
+		})
+	}
+}
+
+func TestNextFrame(t *testing.T) {
+	tests := []struct {
+		name     string
+		buf      []byte
+		want     []byte
+		wantRest []byte
+		wantOK   bool
+	}{
+		{
+			name:     "empty",
+			buf:      []byte{},
+			wantRest: []byte{},
+		},
+		{
+			name:     "partial header",
+			buf:      []byte{0},
+			wantRest: []byte{0},
+		},
+		{
+			name:     "partial payload",
+			buf:      []byte{0, 3, 'a', 'b'},
+			wantRest: []byte{0, 3, 'a', 'b'},
+		},
+		{
+			name:     "complete",
+			buf:      []byte{0, 3, 'a', 'b', 'c'},
+			want:     []byte("abc"),
+			wantRest: []byte{},
+			wantOK:   true,
+		},
+		{
+			name:     "complete with the start of the next",
+			buf:      []byte{0, 1, 'a', 0, 2, 'b'},
+			want:     []byte("a"),
+			wantRest: []byte{0, 2, 'b'},
+			wantOK:   true,
+		},
+		{
+			name:     "empty datagram",
+			buf:      []byte{0, 0, 0, 1, 'a'},
+			want:     []byte{},
+			wantRest: []byte{0, 1, 'a'},
+			wantOK:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, rest, ok := NextFrame(tt.buf)
+			if ok != tt.wantOK {
+				t.Fatalf("NextFrame() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NextFrame() datagram = %q, want %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(rest, tt.wantRest) {
+				t.Errorf("NextFrame() rest = %q, want %q", rest, tt.wantRest)
+			}
+		})
+	}
+}
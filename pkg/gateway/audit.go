@@ -0,0 +1,187 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// AuditLogStdout is the audit log path that writes audit events to stdout
+	AuditLogStdout = "-"
+
+	DefaultAuditLogMaxSizeMB  = 100
+	DefaultAuditLogMaxBackups = 3
+)
+
+// Audit configures where the gateway records the dials that it allows or refuses
+type Audit struct {
+	// Path is the file to write audit events to as JSON lines, or "-" to write them to stdout. If unset, no audit log is written
+	Path string `yaml:"path,omitempty"`
+	// MaxSizeMB is the size in megabytes an audit log file can grow to before it is rotated
+	MaxSizeMB int `yaml:"maxSizeMB,omitempty"`
+	// MaxBackups is the number of rotated audit log files to keep
+	MaxBackups int `yaml:"maxBackups,omitempty"`
+}
+
+// auditEvent records a single dial requested by a proxy
+type auditEvent struct {
+	Time     time.Time `json:"time"`
+	ProxyURL string    `json:"proxyUrl"`
+	Proto    string    `json:"proto"`
+	Address  string    `json:"address"`
+	Allowed  bool      `json:"allowed"`
+	Rule     string    `json:"rule,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	// BytesSent is the number of bytes sent to the address on behalf of the proxy
+	BytesSent int64 `json:"bytesSent"`
+	// BytesReceived is the number of bytes received from the address and returned to the proxy
+	BytesReceived int64  `json:"bytesReceived"`
+	Duration      string `json:"duration"`
+}
+
+// auditLog writes audit events as JSON lines. A nil auditLog discards all events
+type auditLog struct {
+	lock sync.Mutex
+	out  io.Writer
+}
+
+func newAuditLog(config Audit) (*auditLog, error) {
+	switch config.Path {
+	case "":
+		return nil, nil
+	case AuditLogStdout:
+		return &auditLog{out: os.Stdout}, nil
+	}
+	if config.MaxSizeMB <= 0 {
+		config.MaxSizeMB = DefaultAuditLogMaxSizeMB
+	}
+	if config.MaxBackups < 0 {
+		config.MaxBackups = 0
+	}
+	out, err := newRotatingFile(config.Path, int64(config.MaxSizeMB)*1024*1024, config.MaxBackups)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open audit log %s: %s", config.Path, err)
+	}
+	return &auditLog{out: out}, nil
+}
+
+func (a *auditLog) record(event auditEvent) {
+	if a == nil {
+		return
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		logrus.Errorf("unable to encode audit event: %s", err)
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, err := a.out.Write(append(line, '\n')); err != nil {
+		logrus.Errorf("unable to write audit event: %s", err)
+	}
+}
+
+// auditedConn counts the bytes passed through a dialed connection and records an audit event once it is closed
+type auditedConn struct {
+	net.Conn
+
+	bytesSent     int64
+	bytesReceived int64
+	closeOnce     sync.Once
+	onClose       func(bytesSent, bytesReceived int64)
+}
+
+func (c *auditedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.bytesReceived, int64(n))
+	return n, err
+}
+
+func (c *auditedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.bytesSent, int64(n))
+	return n, err
+}
+
+func (c *auditedConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		c.onClose(atomic.LoadInt64(&c.bytesSent), atomic.LoadInt64(&c.bytesReceived))
+	})
+	return err
+}
+
+// rotatingFile is a file that is rotated once writing to it would exceed maxSize bytes.
+// Rotated files are renamed with an increasing numeric suffix, i.e. path.1 is the most recent
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	file *os.File
+	size int64
+}
+
+func newRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	return f, f.open()
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(b []byte) (int, error) {
+	if f.size > 0 && f.size+int64(len(b)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if f.maxBackups == 0 {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return f.open()
+	}
+	for i := f.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		return err
+	}
+	return f.open()
+}
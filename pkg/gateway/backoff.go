@@ -0,0 +1,78 @@
+package gateway
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	DefaultBackoffInitial = 1 * time.Second
+	DefaultBackoffMax     = 2 * time.Minute
+	DefaultBackoffFactor  = 2.0
+	DefaultBackoffJitter  = 0.5
+)
+
+// Backoff configures how long a gateway waits between attempts to connect to a proxy
+type Backoff struct {
+	// Initial is the delay before the first reconnect attempt
+	Initial time.Duration `yaml:"initial,omitempty"`
+	// Max caps the delay between reconnect attempts
+	Max time.Duration `yaml:"max,omitempty"`
+	// Factor is what the delay is multiplied by after each failed attempt
+	Factor float64 `yaml:"factor,omitempty"`
+	// Jitter is the fraction of the delay that is randomized so that gateways do not reconnect in lockstep
+	Jitter float64 `yaml:"jitter,omitempty"`
+}
+
+func (b Backoff) withDefaults() Backoff {
+	if b.Initial <= 0 {
+		b.Initial = DefaultBackoffInitial
+	}
+	if b.Max <= 0 {
+		b.Max = DefaultBackoffMax
+	}
+	if b.Max < b.Initial {
+		b.Max = b.Initial
+	}
+	if b.Factor < 1 {
+		b.Factor = DefaultBackoffFactor
+	}
+	if b.Jitter < 0 || b.Jitter > 1 {
+		b.Jitter = DefaultBackoffJitter
+	}
+	return b
+}
+
+// backoffTimer computes successive delays for a single tunnel
+type backoffTimer struct {
+	Backoff
+
+	attempts int
+	rand     *rand.Rand
+}
+
+func newBackoffTimer(b Backoff) *backoffTimer {
+	return &backoffTimer{
+		Backoff: b.withDefaults(),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// next returns the delay to wait before the next attempt
+func (t *backoffTimer) next() time.Duration {
+	delay := float64(t.Initial) * math.Pow(t.Factor, float64(t.attempts))
+	if delay > float64(t.Max) {
+		delay = float64(t.Max)
+	} else {
+		t.attempts++
+	}
+	// subtract a random portion of the delay so that the cap is never exceeded
+	delay -= delay * t.Jitter * t.rand.Float64()
+	return time.Duration(delay)
+}
+
+// reset starts the next series of attempts from the initial delay
+func (t *backoffTimer) reset() {
+	t.attempts = 0
+}
@@ -0,0 +1,207 @@
+package gateway
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxShapedChunk is the largest number of bytes read or written in one go by a shaped connection
+	maxShapedChunk = 32 * 1024
+)
+
+// Bandwidth limits the rate at which bytes are piped through tunneled connections, in bytes per second.
+// Each limit applies separately to each direction. A zero value for any limit disables it
+type Bandwidth struct {
+	// Limit is shared by all tunneled connections
+	Limit int64 `yaml:"limit,omitempty"`
+	// LimitPerTarget is shared by all tunneled connections to the same address
+	LimitPerTarget int64 `yaml:"limitPerTarget,omitempty"`
+	// LimitPerTunnel is shared by all connections requested by the same proxy
+	LimitPerTunnel int64 `yaml:"limitPerTunnel,omitempty"`
+}
+
+// bandwidthLimiter shapes the bytes sent to and received from tunneled connections
+type bandwidthLimiter struct {
+	sent     *tokenBucket
+	received *tokenBucket
+}
+
+func newBandwidthLimiter(limit int64) *bandwidthLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	// allow up to a second's worth of bytes to be piped at once
+	return &bandwidthLimiter{
+		sent:     newTokenBucket(float64(limit), int(limit)),
+		received: newTokenBucket(float64(limit), int(limit)),
+	}
+}
+
+// bandwidthLimiters holds a bandwidth limiter per target address, created on first use and removed once the last
+// connection to the address is closed
+type bandwidthLimiters struct {
+	limit int64
+
+	lock     sync.Mutex
+	limiters map[string]*sharedBandwidthLimiter
+}
+
+type sharedBandwidthLimiter struct {
+	*bandwidthLimiter
+	refs int
+}
+
+// acquire returns the limiter for an address along with a function that must be called once the connection that
+// uses it is closed
+func (l *bandwidthLimiters) acquire(address string) (*bandwidthLimiter, func()) {
+	if l.limit <= 0 {
+		return nil, func() {}
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.limiters == nil {
+		l.limiters = make(map[string]*sharedBandwidthLimiter)
+	}
+	limiter, ok := l.limiters[address]
+	if !ok {
+		limiter = &sharedBandwidthLimiter{bandwidthLimiter: newBandwidthLimiter(l.limit)}
+		l.limiters[address] = limiter
+	}
+	limiter.refs++
+	return limiter.bandwidthLimiter, func() {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		limiter.refs--
+		if limiter.refs == 0 {
+			delete(l.limiters, address)
+		}
+	}
+}
+
+// shapedConn limits the rate of bytes piped through a connection and reports them to throughput meters
+type shapedConn struct {
+	net.Conn
+
+	limiters []*bandwidthLimiter
+	chunk    int
+	sent     []*throughputMeter
+	received []*throughputMeter
+}
+
+func newShapedConn(conn net.Conn, limiters []*bandwidthLimiter, sent, received []*throughputMeter) *shapedConn {
+	c := &shapedConn{
+		Conn:     conn,
+		chunk:    maxShapedChunk,
+		sent:     sent,
+		received: received,
+	}
+	for _, limiter := range limiters {
+		if limiter == nil {
+			continue
+		}
+		c.limiters = append(c.limiters, limiter)
+		// never ask a bucket for more than it can hold
+		if burst := int(limiter.sent.burst); burst < c.chunk {
+			c.chunk = burst
+		}
+	}
+	return c
+}
+
+func (c *shapedConn) Read(b []byte) (int, error) {
+	if len(b) > c.chunk {
+		b = b[:c.chunk]
+	}
+	// reserve the whole buffer before reading, like Write does, and return what was not read
+	for _, limiter := range c.limiters {
+		limiter.received.wait(len(b))
+	}
+	n, err := c.Conn.Read(b)
+	for _, limiter := range c.limiters {
+		limiter.received.refund(len(b) - n)
+	}
+	for _, m := range c.received {
+		m.add(n)
+	}
+	return n, err
+}
+
+func (c *shapedConn) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > c.chunk {
+			chunk = chunk[:c.chunk]
+		}
+		for _, limiter := range c.limiters {
+			limiter.sent.wait(len(chunk))
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		for _, m := range c.sent {
+			m.add(n)
+		}
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// throughputMeter measures the rate of bytes piped through tunneled connections
+type throughputMeter struct {
+	total int64
+
+	lock           sync.RWMutex
+	lastTotal      int64
+	lastSample     time.Time
+	bytesPerSecond float64
+}
+
+func newThroughputMeter() *throughputMeter {
+	return &throughputMeter{
+		lastSample: time.Now(),
+	}
+}
+
+func (m *throughputMeter) add(n int) {
+	atomic.AddInt64(&m.total, int64(n))
+}
+
+// sample updates the measured rate with the bytes piped since the last sample
+func (m *throughputMeter) sample() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	total := atomic.LoadInt64(&m.total)
+	if elapsed := now.Sub(m.lastSample).Seconds(); elapsed > 0 {
+		m.bytesPerSecond = float64(total-m.lastTotal) / elapsed
+	}
+	m.lastTotal = total
+	m.lastSample = now
+}
+
+func (m *throughputMeter) rate() float64 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.bytesPerSecond
+}
+
+// throughputStatus is a snapshot of the rate of bytes piped through tunneled connections
+type throughputStatus struct {
+	// SentBytesPerSecond is the rate of bytes sent to addresses on behalf of proxies
+	SentBytesPerSecond float64 `json:"sentBytesPerSecond"`
+	// ReceivedBytesPerSecond is the rate of bytes received from addresses and returned to proxies
+	ReceivedBytesPerSecond float64 `json:"receivedBytesPerSecond"`
+}
+
+func newThroughputStatus(sent, received *throughputMeter) throughputStatus {
+	return throughputStatus{
+		SentBytesPerSecond:     sent.rate(),
+		ReceivedBytesPerSecond: received.rate(),
+	}
+}
@@ -1,9 +1,28 @@
 package gateway
 
-import "github.com/aiyengar2/portexporter/pkg/config"
+import (
+	"time"
+
+	"github.com/aiyengar2/portexporter/pkg/config"
+)
 
 // Config represents the configuration of a Gateway
 type Config struct {
 	config.TLSClient
-	Expose []string `yaml:"expose,omitempty"`
+	Expose  []string `yaml:"expose,omitempty"`
+	Targets []Target `yaml:"targets,omitempty"`
+	// Redirector configures redirects served by the gateway in-process. If no redirects are configured, none are served
+	Redirector Redirector `yaml:"redirector,omitempty"`
+	// UpstreamProxy configures an HTTP(S) proxy that the gateway connects to proxies through
+	UpstreamProxy UpstreamProxy `yaml:"upstreamProxy,omitempty"`
+	Backoff       Backoff       `yaml:"backoff,omitempty"`
+	Audit         Audit         `yaml:"audit,omitempty"`
+	Limits        Limits        `yaml:"limits,omitempty"`
+	Bandwidth     Bandwidth     `yaml:"bandwidth,omitempty"`
+	// GiveUpAfter is how long the gateway can go without a session with any proxy before it exits. If unset, it never gives up
+	GiveUpAfter time.Duration `yaml:"giveUpAfter,omitempty"`
+	// UDPFlowTimeout is how long a tunneled UDP flow can go without any datagrams before it is closed
+	UDPFlowTimeout time.Duration `yaml:"udpFlowTimeout,omitempty"`
+	// StatusAddress is the local address to serve the status of the gateway on. If unset, no status is served
+	StatusAddress string `yaml:"statusAddress,omitempty"`
 }
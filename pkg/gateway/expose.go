@@ -0,0 +1,182 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// exposeAllRule is the rule reported as matched when no expose rules are configured
+	exposeAllRule = "*"
+)
+
+var (
+	// exposeProtos are the protocols that can be exposed through the gateway
+	exposeProtos = []string{"tcp", "udp", "unix"}
+)
+
+// exposeRules determine which addresses a proxy is allowed to dial through the gateway
+type exposeRules struct {
+	// exposeAll is set if no expose rules were configured, in which case every tcp and udp address is exposed
+	exposeAll bool
+	// addresses maps a protocol and address (e.g. udp://127.0.0.1:8125) to the rule that exposes it
+	addresses map[string]exposeRule
+	// virtualHosts maps a virtual host name that proxies can dial to the rule that exposes it
+	virtualHosts map[string]exposeRule
+	// servers serve the rules that are served in-process
+	servers []*inProcessServer
+}
+
+// exposeRule exposes an address through the gateway
+type exposeRule struct {
+	// rule is the expose rule as it was configured
+	rule string
+	// network and address are what the gateway dials locally to serve the rule.
+	// If address is empty, the address requested by the proxy is dialed
+	network string
+	address string
+	// listener, if set, serves the rule in-process instead of the gateway dialing an address
+	listener *pipeListener
+	// tlsConfig, if set, is used to originate TLS over the dialed connection
+	tlsConfig *tls.Config
+}
+
+// newExposeRules parses expose rules of the form [tcp://|udp://]host:port or unix:///path/to.sock.
+// Rules without a protocol expose tcp addresses. Unix sockets are exposed under a virtual host named after the socket file
+// and targets are exposed under a virtual host with their name
+func newExposeRules(expose []string, targets []Target) (*exposeRules, error) {
+	rules := &exposeRules{
+		exposeAll:    len(expose) == 0,
+		addresses:    make(map[string]exposeRule),
+		virtualHosts: make(map[string]exposeRule),
+	}
+	for _, rule := range expose {
+		proto, address, err := parseExposeAddress(rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expose rule %s: %s", rule, err)
+		}
+		if proto == "unix" {
+			if err := rules.addVirtualHost(filepath.Base(address), exposeRule{rule: rule, network: proto, address: address}); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		rules.addresses[exposeKey(proto, address)] = exposeRule{rule: rule, network: proto}
+	}
+	for _, target := range targets {
+		proto, address, err := parseExposeAddress(target.Address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target %s: %s", target, err)
+		}
+		rule := exposeRule{rule: target.String(), network: proto, address: address}
+		if target.OriginateTLS {
+			if proto != "tcp" {
+				return nil, fmt.Errorf("invalid target %s: TLS can only be originated for tcp addresses", target)
+			}
+			if target.TokenFile == "" {
+				rule.tlsConfig, err = originationTLSConfig(target, address)
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				// tokens can only be added to HTTP requests, so those are proxied in-process
+				server, err := newTLSOriginationServer(target, address)
+				if err != nil {
+					return nil, err
+				}
+				rule.listener = server.listener
+				rules.servers = append(rules.servers, server)
+			}
+		}
+		if err := rules.addVirtualHost(target.Name, rule); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// parseExposeAddress splits an address of the form [tcp://|udp://|unix://]address into its protocol and address
+func parseExposeAddress(exposeAddress string) (string, string, error) {
+	proto, address := "tcp", exposeAddress
+	if i := strings.Index(exposeAddress, "://"); i >= 0 {
+		proto, address = exposeAddress[:i], exposeAddress[i+3:]
+	}
+	if !isExposeProto(proto) {
+		return "", "", fmt.Errorf("protocol must be one of %s", strings.Join(exposeProtos, ", "))
+	}
+	if address == "" {
+		return "", "", fmt.Errorf("no address provided")
+	}
+	return proto, address, nil
+}
+
+func (r *exposeRules) addVirtualHost(name string, rule exposeRule) error {
+	if existing, ok := r.virtualHosts[name]; ok {
+		return fmt.Errorf("virtual host %s of %s is already used by %s", name, rule.rule, existing.rule)
+	}
+	r.virtualHosts[name] = rule
+	return nil
+}
+
+// virtualHostNames returns the sorted names of the virtual hosts that proxies can dial through the gateway
+func (r *exposeRules) virtualHostNames() []string {
+	var names []string
+	for name := range r.virtualHosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// match returns the rule that allows a proxy to dial the address, if any
+func (r *exposeRules) match(proto, address string) (exposeRule, bool) {
+	if proto != "tcp" && proto != "udp" {
+		// proxies can only reach unix sockets through virtual hosts
+		return exposeRule{}, false
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	if rule, ok := r.virtualHosts[host]; ok {
+		// unix sockets are streamed like tcp connections
+		if rule.network == proto || (rule.network == "unix" && proto == "tcp") {
+			return rule, true
+		}
+		return exposeRule{}, false
+	}
+	// if there are no rules, then we expose everything by default
+	// otherwise, only expose an address if it is in the list of exposable addresses
+	//
+	// TODO: should not expose everything by default...
+	if r.exposeAll {
+		return exposeRule{rule: exposeAllRule, network: proto}, true
+	}
+	rule, ok := r.addresses[exposeKey(proto, address)]
+	return rule, ok
+}
+
+// dialAddress returns the network and address that the gateway dials locally when a proxy requests the address
+func (r exposeRule) dialAddress(address string) (string, string) {
+	if r.address == "" {
+		return r.network, address
+	}
+	return r.network, r.address
+}
+
+func exposeKey(proto, address string) string {
+	return fmt.Sprintf("%s://%s", proto, address)
+}
+
+func isExposeProto(proto string) bool {
+	for _, p := range exposeProtos {
+		if proto == p {
+			return true
+		}
+	}
+	return false
+}
@@ -2,72 +2,290 @@ package gateway
 
 import (
 	"context"
-	"crypto/tls"
+	"fmt"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/aiyengar2/portexporter/pkg/utils"
-	"github.com/gorilla/websocket"
 	"github.com/rancher/remotedialer"
 	"github.com/sirupsen/logrus"
 )
 
 type gatewayServer struct {
-	proxyUrl  string
-	expose    []string
-	tlsConfig *tls.Config
+	tunnels        []*tunnel
+	expose         []string
+	targets        []Target
+	redirector     Redirector
+	upstreamProxy  UpstreamProxy
+	rules          *exposeRules
+	auditConfig    Audit
+	audit          *auditLog
+	limiter        *connLimiter
+	udpFlowTimeout time.Duration
+	giveUpAfter    time.Duration
+	statusAddress  string
+
+	bandwidth       *bandwidthLimiter
+	targetBandwidth *bandwidthLimiters
+	sent            *throughputMeter
+	received        *throughputMeter
+
+	id        string
+	startTime time.Time
 }
 
-func NewServer(proxyUrl string, config Config) *gatewayServer {
+// NewServer returns a gateway that maintains a session with each of the provided proxies
+func NewServer(proxyUrls []string, config Config) (*gatewayServer, error) {
 	s := &gatewayServer{
-		proxyUrl: proxyUrl,
-		expose:   config.Expose,
+		expose:         config.Expose,
+		targets:        config.Targets,
+		redirector:     config.Redirector,
+		upstreamProxy:  config.UpstreamProxy,
+		auditConfig:    config.Audit,
+		limiter:        newConnLimiter(config.Limits),
+		udpFlowTimeout: config.UDPFlowTimeout,
+		giveUpAfter:    config.GiveUpAfter,
+		statusAddress:  config.StatusAddress,
+
+		bandwidth:       newBandwidthLimiter(config.Bandwidth.Limit),
+		targetBandwidth: &bandwidthLimiters{limit: config.Bandwidth.LimitPerTarget},
+		sent:            newThroughputMeter(),
+		received:        newThroughputMeter(),
 	}
-	if strings.HasPrefix(s.proxyUrl, "wss://") {
-		s.tlsConfig = config.TLSConfig(proxyUrl)
+	for _, proxyUrl := range proxyUrls {
+		t, err := newTunnel(proxyUrl, config)
+		if err != nil {
+			return nil, err
+		}
+		s.tunnels = append(s.tunnels, t)
 	}
-	return s
+	return s, nil
 }
 
 func (s *gatewayServer) Start(ctx context.Context) error {
-	ip := utils.GetHostIP()
-	logrus.Infof("Using id [%s]", ip)
+	var err error
+	s.rules, err = newExposeRules(s.expose, s.targets)
+	if err != nil {
+		return err
+	}
+	s.audit, err = newAuditLog(s.auditConfig)
+	if err != nil {
+		return err
+	}
+
+	if s.upstreamProxy.URL != "" {
+		upstream, err := newUpstreamDialer(s.upstreamProxy)
+		if err != nil {
+			return err
+		}
+		logrus.Infof("Connecting to proxies through upstream proxy %s", s.upstreamProxy)
+		for _, t := range s.tunnels {
+			t.upstream = upstream
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for _, server := range s.rules.servers {
+		server.Start(ctx)
+	}
+	if len(s.redirector.Redirect) > 0 {
+		name := s.redirector.Name
+		if name == "" {
+			name = DefaultRedirectorName
+		}
+		redirector, err := newRedirectorServer(s.redirector.Config)
+		if err != nil {
+			return err
+		}
+		if err := s.rules.addVirtualHost(name, exposeRule{rule: "in-process redirector", network: "tcp", listener: redirector.listener}); err != nil {
+			return err
+		}
+		redirector.Start(ctx)
+	}
+
+	s.id = utils.GetHostIP()
+	s.startTime = time.Now()
+	logrus.Infof("Using id [%s]", s.id)
 
 	headers := http.Header{
-		"X-Proxy-Tunnel-ID": []string{ip},
+		"X-Proxy-Tunnel-ID": []string{s.id},
+	}
+	if targets := s.rules.virtualHostNames(); len(targets) > 0 {
+		// advertise the virtual hosts that the proxy can reach through this gateway
+		logrus.Infof("Advertising targets %s", strings.Join(targets, ", "))
+		headers.Set("X-Proxy-Tunnel-Targets", strings.Join(targets, ","))
+	}
+
+	if s.statusAddress != "" {
+		newStatusServer(s.statusAddress, s).Start(ctx)
+	}
+	go s.sampleThroughput(ctx)
+
+	// each tunnel reconnects independently so that losing one proxy does not affect sessions with the others
+	var wg sync.WaitGroup
+	for _, t := range s.tunnels {
+		wg.Add(1)
+		go func(t *tunnel) {
+			defer wg.Done()
+			t.run(ctx, headers, s.connectAuthorizer(t), s.localDialer(t))
+		}(t)
+	}
+
+	if s.giveUpAfter > 0 {
+		err = s.waitForSession(ctx)
+		cancel()
 	}
-	connAuth := getConnectAuthorizer(s.expose)
-	dialer := &websocket.Dialer{
-		Proxy:            http.ProxyFromEnvironment,
-		HandshakeTimeout: remotedialer.HandshakeTimeOut,
-		TLSClientConfig:  s.tlsConfig,
+	wg.Wait()
+	return err
+}
+
+// sampleThroughput periodically updates the throughput reported by the gateway and its tunnels
+func (s *gatewayServer) sampleThroughput(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.sent.sample()
+		s.received.sample()
+		for _, t := range s.tunnels {
+			t.sent.sample()
+			t.received.sample()
+		}
+	}
+}
+
+// isReady returns whether the gateway has a session with at least one proxy
+func (s *gatewayServer) isReady() bool {
+	for _, t := range s.tunnels {
+		if t.isConnected() {
+			return true
+		}
 	}
-	return remotedialer.ClientConnect(ctx, s.proxyUrl, headers, dialer, connAuth, onConnect)
+	return false
 }
 
-func getConnectAuthorizer(expose []string) remotedialer.ConnectAuthorizer {
-	var addressMap map[string]bool
-	if len(expose) > 0 {
-		addressMap = make(map[string]bool)
-		for _, address := range expose {
-			addressMap[address] = true
+// waitForSession blocks until the context is done or returns an error once the gateway
+// has gone without a session with any proxy for longer than giveUpAfter
+func (s *gatewayServer) waitForSession(ctx context.Context) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		var lastActive time.Time
+		for _, t := range s.tunnels {
+			inactiveSince := t.inactiveSince()
+			if inactiveSince.IsZero() {
+				// tunnel is connected
+				lastActive = time.Now()
+				break
+			}
+			if inactiveSince.After(lastActive) {
+				lastActive = inactiveSince
+			}
+		}
+		if time.Since(lastActive) > s.giveUpAfter {
+			return fmt.Errorf("giving up: no session with any proxy for over %s", s.giveUpAfter)
 		}
 	}
+}
 
+// connectAuthorizer returns the authorizer for connections requested by the proxy that a tunnel is connected to
+func (s *gatewayServer) connectAuthorizer(t *tunnel) remotedialer.ConnectAuthorizer {
 	return func(proto, address string) bool {
 		logrus.Debugf("Received request to %s://%s", proto, address)
-		if proto != "tcp" {
-			// only tcp is supported
+		if _, ok := s.rules.match(proto, address); !ok {
+			s.audit.record(auditEvent{
+				Time:     time.Now(),
+				ProxyURL: t.proxyUrl,
+				Proto:    proto,
+				Address:  address,
+				Allowed:  false,
+				Duration: "0s",
+			})
+			atomic.AddUint64(&t.dialsRefused, 1)
 			return false
 		}
-		// if addressMap is nil, then we expose everything by default
-		// otherwise, only expose an address if it is in the list of exposable addresses
-		//
-		// TODO: should not expose everything by default...
-		return addressMap == nil || addressMap[address]
+		return true
 	}
 }
 
-func onConnect(ctx context.Context, _ *remotedialer.Session) error {
-	return nil
+// localDialer returns the dialer for connections requested by the proxy that a tunnel is connected to
+func (s *gatewayServer) localDialer(t *tunnel) remotedialer.Dialer {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		start := time.Now()
+		event := auditEvent{
+			Time:     start,
+			ProxyURL: t.proxyUrl,
+			Proto:    network,
+			Address:  address,
+			Allowed:  true,
+		}
+		rule, _ := s.rules.match(network, address)
+		event.Rule = rule.rule
+
+		release, err := s.limiter.acquire(address)
+		if err != nil {
+			logrus.WithField("url", t.proxyUrl).Warnf("Refusing connection to %s://%s: %s", network, address, err)
+			event.Allowed = false
+			event.Error = err.Error()
+			event.Duration = time.Since(start).String()
+			s.audit.record(event)
+			atomic.AddUint64(&t.dialsRefused, 1)
+			return nil, err
+		}
+		atomic.AddUint64(&t.dialsServed, 1)
+
+		var conn net.Conn
+		if rule.listener != nil {
+			conn, err = rule.listener.DialContext(ctx)
+		} else {
+			dialNetwork, dialAddress := rule.dialAddress(address)
+			d := net.Dialer{}
+			conn, err = d.DialContext(ctx, dialNetwork, dialAddress)
+			if err == nil && rule.tlsConfig != nil {
+				conn, err = originateTLS(ctx, conn, rule.tlsConfig)
+			}
+		}
+		if err != nil {
+			release()
+			event.Error = err.Error()
+			event.Duration = time.Since(start).String()
+			s.audit.record(event)
+			return nil, err
+		}
+		if network == "udp" {
+			conn = newDatagramConn(conn, s.udpFlowTimeout)
+		}
+		targetBandwidth, releaseTargetBandwidth := s.targetBandwidth.acquire(address)
+		conn = newShapedConn(conn,
+			[]*bandwidthLimiter{s.bandwidth, targetBandwidth, t.bandwidth},
+			[]*throughputMeter{s.sent, t.sent},
+			[]*throughputMeter{s.received, t.received},
+		)
+		return &auditedConn{
+			Conn: conn,
+			onClose: func(bytesSent, bytesReceived int64) {
+				release()
+				releaseTargetBandwidth()
+				event.BytesSent = bytesSent
+				event.BytesReceived = bytesReceived
+				event.Duration = time.Since(start).String()
+				s.audit.record(event)
+			},
+		}, nil
+	}
 }
@@ -0,0 +1,108 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// inProcessServer serves HTTP over connections dialed in-process by the gateway
+type inProcessServer struct {
+	*http.Server
+
+	listener *pipeListener
+}
+
+func newInProcessServer(handler http.Handler) *inProcessServer {
+	return &inProcessServer{
+		Server: &http.Server{
+			WriteTimeout: time.Second * 15,
+			ReadTimeout:  time.Second * 15,
+			IdleTimeout:  time.Second * 60,
+			// disable HTTP/2 support
+			TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+			Handler:      handler,
+		},
+		listener: newPipeListener(),
+	}
+}
+
+func (s *inProcessServer) Start(ctx context.Context) {
+	go func() {
+		if err := s.Serve(s.listener); err != nil && err != http.ErrServerClosed {
+			logrus.Error(err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		s.Shutdown(context.Background())
+	}()
+}
+
+var errListenerClosed = errors.New("listener closed")
+
+// pipeListener is a net.Listener for connections that are dialed in-process
+type pipeListener struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// DialContext returns one end of a connection whose other end is accepted by the listener
+func (l *pipeListener) DialContext(ctx context.Context) (conn net.Conn, err error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		err = errListenerClosed
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	client.Close()
+	server.Close()
+	return nil, err
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (pipeAddr) String() string {
+	return "in-process"
+}
@@ -0,0 +1,148 @@
+package gateway
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Limits bound the connections that proxies can open through a gateway. A zero value for any limit disables it
+type Limits struct {
+	// MaxConnections is the maximum number of tunneled connections that can be open at once
+	MaxConnections int `yaml:"maxConnections,omitempty"`
+	// MaxConnectionsPerTarget is the maximum number of tunneled connections that can be open to a single address at once
+	MaxConnectionsPerTarget int `yaml:"maxConnectionsPerTarget,omitempty"`
+	// DialRate is the number of dials per second that proxies are allowed to make through the gateway
+	DialRate float64 `yaml:"dialRate,omitempty"`
+	// DialBurst is the number of dials that can be made at once before DialRate applies
+	DialBurst int `yaml:"dialBurst,omitempty"`
+}
+
+// connLimiter enforces Limits on the connections served by a gateway
+type connLimiter struct {
+	Limits
+
+	lock            sync.Mutex
+	active          int
+	activePerTarget map[string]int
+	dialBucket      *tokenBucket
+}
+
+func newConnLimiter(limits Limits) *connLimiter {
+	l := &connLimiter{
+		Limits:          limits,
+		activePerTarget: make(map[string]int),
+	}
+	if limits.DialRate > 0 {
+		l.dialBucket = newTokenBucket(limits.DialRate, limits.DialBurst)
+	}
+	return l
+}
+
+// acquire reserves a connection to the address, returning a function that must be called once the connection is closed
+func (l *connLimiter) acquire(address string) (func(), error) {
+	if l.dialBucket != nil && !l.dialBucket.allow() {
+		return nil, fmt.Errorf("gateway dial rate limit of %g/s exceeded", l.DialRate)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.MaxConnections > 0 && l.active >= l.MaxConnections {
+		return nil, fmt.Errorf("gateway limit of %d concurrent connections reached", l.MaxConnections)
+	}
+	if l.MaxConnectionsPerTarget > 0 && l.activePerTarget[address] >= l.MaxConnectionsPerTarget {
+		return nil, fmt.Errorf("gateway limit of %d concurrent connections to %s reached", l.MaxConnectionsPerTarget, address)
+	}
+	l.active++
+	l.activePerTarget[address]++
+
+	var releaseOnce sync.Once
+	return func() {
+		releaseOnce.Do(func() {
+			l.release(address)
+		})
+	}, nil
+}
+
+func (l *connLimiter) release(address string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.active--
+	l.activePerTarget[address]--
+	if l.activePerTarget[address] <= 0 {
+		delete(l.activePerTarget, address)
+	}
+}
+
+// tokenBucket is a token bucket that refills at a constant rate up to its burst size
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// refill adds the tokens accumulated since the last refill. Must be called with the lock held
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// wait takes n tokens from the bucket, blocking until the bucket has refilled enough to cover them.
+// The bucket can go into debt, so callers should never ask for more tokens than the burst size
+func (b *tokenBucket) wait(n int) {
+	if n <= 0 {
+		return
+	}
+	b.lock.Lock()
+	b.refill()
+	b.tokens -= float64(n)
+	deficit := -b.tokens
+	b.lock.Unlock()
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / b.rate * float64(time.Second)))
+	}
+}
+
+// refund returns n tokens that were taken by wait but not used
+func (b *tokenBucket) refund(n int) {
+	if n <= 0 {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill()
+	b.tokens += float64(n)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// allow takes a single token from the bucket if one is available
+func (b *tokenBucket) allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
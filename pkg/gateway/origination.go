@@ -0,0 +1,94 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// originationTLSConfig returns the configuration used to originate TLS to the address of a target
+func originationTLSConfig(target Target, address string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target %s: %s", target, err)
+	}
+	tlsConfig, err := target.TLSConfig(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target %s: %s", target, err)
+	}
+	return tlsConfig, nil
+}
+
+// newTLSOriginationServer returns a server that forwards plain HTTP requests to a target over HTTPS, adding its token
+func newTLSOriginationServer(target Target, address string) (*inProcessServer, error) {
+	tlsConfig, err := originationTLSConfig(target, address)
+	if err != nil {
+		return nil, err
+	}
+	director := func(req *http.Request) {
+		req.URL.Scheme = "https"
+		req.URL.Host = address
+		// the virtual host requested by the proxy means nothing to the target
+		req.Host = ""
+		if _, ok := req.Header["User-Agent"]; !ok {
+			// explicitly disable User-Agent so it's not set to default value
+			req.Header.Set("User-Agent", "")
+		}
+	}
+	proxy := &httputil.ReverseProxy{
+		Director: director,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+			TLSClientConfig:       tlsConfig,
+		},
+	}
+	// requests are never forwarded without the token, since the target would see them as unauthenticated
+	return newInProcessServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		token, err := readToken(target.TokenFile)
+		if err != nil {
+			logrus.Errorf("unable to forward request to target %s: %s", target.Name, err)
+			http.Error(rw, fmt.Sprintf("token for target %s is unavailable", target.Name), http.StatusBadGateway)
+			return
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		proxy.ServeHTTP(rw, req)
+	})), nil
+}
+
+// readToken reads a bearer token from a file, returning an error if it cannot be read or is empty
+func readToken(tokenFile string) (string, error) {
+	tokenBytes, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("could not read token from path %s: %s", tokenFile, err)
+	}
+	token := strings.TrimSpace(string(tokenBytes))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", tokenFile)
+	}
+	return token, nil
+}
+
+// originateTLS performs a TLS handshake over a connection dialed to a target, closing it if the handshake fails
+func originateTLS(ctx context.Context, conn net.Conn, tlsConfig *tls.Config) (net.Conn, error) {
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
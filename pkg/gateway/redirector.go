@@ -0,0 +1,33 @@
+package gateway
+
+import "github.com/aiyengar2/portexporter/pkg/redirect"
+
+const (
+	DefaultRedirectorName = "redirector"
+)
+
+// Redirector configures redirects that the gateway serves in-process, through a virtual host of the
+// form <name>.<tunnel ID> (e.g. redirector.10.0.0.7/https/127.0.0.1:10250/metrics)
+type Redirector struct {
+	// Name is the virtual host that proxies dial to reach the redirector
+	Name            string `yaml:"name,omitempty"`
+	redirect.Config `yaml:",inline"`
+}
+
+// newRedirectorServer returns a server for the redirect routes of the provided configuration
+func newRedirectorServer(config redirect.Config) (*inProcessServer, error) {
+	router := redirect.Router()
+	for i := range config.Redirect {
+		r := &config.Redirect[i]
+		if err := router.RegisterHandler(r.Address, r); err != nil {
+			router.Close()
+			return nil, err
+		}
+	}
+	server := newInProcessServer(router)
+	// stop watching the files of the redirects once the server is shut down
+	server.RegisterOnShutdown(func() {
+		router.Close()
+	})
+	return server, nil
+}
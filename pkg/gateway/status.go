@@ -0,0 +1,92 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aiyengar2/portexporter/pkg/config"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+// statusServer serves the health, readiness and status of a gateway on a local address
+type statusServer struct {
+	*http.Server
+
+	gateway *gatewayServer
+}
+
+type gatewayStatus struct {
+	ID           string                     `json:"id"`
+	Ready        bool                       `json:"ready"`
+	Uptime       string                     `json:"uptime"`
+	Throughput   throughputStatus           `json:"throughput"`
+	Tunnels      []tunnelStatus             `json:"tunnels"`
+	Certificates []config.CertificateExpiry `json:"certificates,omitempty"`
+}
+
+func newStatusServer(listenAddr string, gateway *gatewayServer) *statusServer {
+	s := &statusServer{
+		gateway: gateway,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+	mux.HandleFunc("/status", s.status)
+	mux.Handle("/metrics", promhttp.Handler())
+	s.Server = &http.Server{
+		Addr:         listenAddr,
+		WriteTimeout: time.Second * 15,
+		ReadTimeout:  time.Second * 15,
+		IdleTimeout:  time.Second * 60,
+		Handler:      mux,
+	}
+	return s
+}
+
+func (s *statusServer) Start(ctx context.Context) {
+	logrus.Infof("Serving gateway health, status and metrics on http://%s", s.Addr)
+	go func() {
+		if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logrus.Error(err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		s.Shutdown(context.Background())
+	}()
+}
+
+// healthz reports that the gateway process is up, regardless of whether it has a session with a proxy
+func (s *statusServer) healthz(rw http.ResponseWriter, req *http.Request) {
+	fmt.Fprint(rw, "ok")
+}
+
+// readyz reports whether the gateway has a session established with at least one proxy
+func (s *statusServer) readyz(rw http.ResponseWriter, req *http.Request) {
+	if !s.gateway.isReady() {
+		http.Error(rw, "no session established with any proxy", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprint(rw, "ok")
+}
+
+func (s *statusServer) status(rw http.ResponseWriter, req *http.Request) {
+	status := gatewayStatus{
+		ID:           s.gateway.id,
+		Ready:        s.gateway.isReady(),
+		Uptime:       time.Since(s.gateway.startTime).Round(time.Second).String(),
+		Throughput:   newThroughputStatus(s.gateway.sent, s.gateway.received),
+		Certificates: config.ExpiryStatus(),
+	}
+	for _, t := range s.gateway.tunnels {
+		status.Tunnels = append(status.Tunnels, t.status())
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(status); err != nil {
+		logrus.Errorf("unable to encode gateway status: %s", err)
+	}
+}
@@ -0,0 +1,63 @@
+package gateway
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aiyengar2/portexporter/pkg/config"
+	"gopkg.in/yaml.v2"
+)
+
+// Target is an address on the network of a gateway that proxies can dial by name, through a virtual host
+// of the form <name>.<tunnel ID> (e.g. node-exporter.10.0.0.7). Any port requested by the proxy is ignored
+type Target struct {
+	Name string `yaml:"name,omitempty"`
+	// Address is the address that the gateway dials for the target, of the form [tcp://|udp://]host:port or unix:///path/to.sock
+	Address string `yaml:"address,omitempty"`
+	// OriginateTLS has the gateway wrap connections to the target in TLS, or upgrade plain HTTP requests to HTTPS if a
+	// TokenFile is set. Only supported for tcp addresses. Expose rules cannot originate TLS, so targets are the only
+	// way to configure it
+	OriginateTLS bool `yaml:"originateTLS,omitempty"`
+	// TLSClient configures how the gateway verifies the target when originating TLS
+	config.TLSClient `yaml:",inline"`
+	// TokenFile is a file containing a bearer token that the gateway adds to requests when originating TLS
+	TokenFile string `yaml:"tokenFile,omitempty"`
+}
+
+// TargetsConfig is a file that configures the targets of a gateway
+type TargetsConfig struct {
+	Targets []Target `yaml:"targets,omitempty"`
+}
+
+// LoadTargets loads the targets configured in a file
+func LoadTargets(configFile string) ([]Target, error) {
+	configBytes, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	var opts TargetsConfig
+	return opts.Targets, yaml.Unmarshal(configBytes, &opts)
+}
+
+// ParseTarget parses a target of the form NAME=ADDRESS (e.g. node-exporter=127.0.0.1:9100)
+func ParseTarget(target string) (Target, error) {
+	parts := strings.SplitN(target, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return Target{}, fmt.Errorf("invalid target %s: expected NAME=ADDRESS", target)
+	}
+	if strings.ContainsAny(parts[0], ":/") {
+		return Target{}, fmt.Errorf("invalid target %s: name cannot contain ':' or '/'", target)
+	}
+	return Target{
+		Name:    parts[0],
+		Address: parts[1],
+	}, nil
+}
+
+func (t Target) String() string {
+	if !t.OriginateTLS {
+		return fmt.Sprintf("[name=%s,address=%s]", t.Name, t.Address)
+	}
+	return fmt.Sprintf("[name=%s,address=%s,originateTLS=%t,tls=%s,tokenFile=%s]", t.Name, t.Address, t.OriginateTLS, t.TLSClient, t.TokenFile)
+}
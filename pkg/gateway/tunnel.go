@@ -0,0 +1,193 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rancher/remotedialer"
+	"github.com/sirupsen/logrus"
+)
+
+type tunnelState string
+
+const (
+	stateConnecting tunnelState = "connecting"
+	stateConnected  tunnelState = "connected"
+	stateBackingOff tunnelState = "backing-off"
+)
+
+// tunnel maintains a remotedialer session with a single proxy
+type tunnel struct {
+	proxyUrl  string
+	tlsConfig *tls.Config
+	backoff   Backoff
+	// upstream, if set, is used to reach the proxy instead of the proxy configured in the environment
+	upstream *upstreamDialer
+
+	dialsServed  uint64
+	dialsRefused uint64
+
+	bandwidth *bandwidthLimiter
+	sent      *throughputMeter
+	received  *throughputMeter
+
+	statusLock sync.RWMutex
+	state      tunnelState
+	lastError  error
+	// lastActive is the last time this tunnel had a session with the proxy
+	lastActive time.Time
+	retryAt    time.Time
+}
+
+// tunnelStatus is a snapshot of the status of a tunnel
+type tunnelStatus struct {
+	ProxyURL   string      `json:"proxyUrl"`
+	State      tunnelState `json:"state"`
+	LastError  string      `json:"lastError,omitempty"`
+	LastActive time.Time   `json:"lastActive"`
+	RetryAt    *time.Time  `json:"retryAt,omitempty"`
+	// DialsServed is the number of dials requested by the proxy that the gateway allowed
+	DialsServed uint64 `json:"dialsServed"`
+	// DialsRefused is the number of dials requested by the proxy that the gateway refused
+	DialsRefused uint64           `json:"dialsRefused"`
+	Throughput   throughputStatus `json:"throughput"`
+}
+
+func newTunnel(proxyUrl string, config Config) (*tunnel, error) {
+	t := &tunnel{
+		proxyUrl:   proxyUrl,
+		backoff:    config.Backoff,
+		bandwidth:  newBandwidthLimiter(config.Bandwidth.LimitPerTunnel),
+		sent:       newThroughputMeter(),
+		received:   newThroughputMeter(),
+		state:      stateConnecting,
+		lastActive: time.Now(),
+	}
+	if strings.HasPrefix(proxyUrl, "wss://") {
+		u, err := url.Parse(proxyUrl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url %s: %s", proxyUrl, err)
+		}
+		t.tlsConfig, err = config.TLSConfig(u.Hostname())
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS configuration for proxy %s: %s", proxyUrl, err)
+		}
+	}
+	return t, nil
+}
+
+// run keeps a session open with the proxy, reconnecting with backoff whenever it is lost, until the context is done
+func (t *tunnel) run(ctx context.Context, headers http.Header, connAuth remotedialer.ConnectAuthorizer, localDialer remotedialer.Dialer) {
+	dialer := &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: remotedialer.HandshakeTimeOut,
+		TLSClientConfig:  t.tlsConfig,
+	}
+	if t.upstream != nil {
+		dialer.Proxy = nil
+		dialer.NetDialContext = t.upstream.DialContext
+	}
+	backoff := newBackoffTimer(t.backoff)
+	for {
+		t.setState(stateConnecting, nil)
+		err := remotedialer.ConnectToProxyWithDialer(ctx, t.proxyUrl, headers, connAuth, dialer, localDialer, t.onConnect)
+		if ctx.Err() != nil {
+			return
+		}
+		if t.disconnect() {
+			// the last attempt managed to establish a session, so start over from the initial delay
+			backoff.reset()
+		}
+		delay := backoff.next()
+		t.setBackingOff(err, delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (t *tunnel) onConnect(ctx context.Context, _ *remotedialer.Session) error {
+	t.setState(stateConnected, nil)
+	return nil
+}
+
+// disconnect records the end of an attempt and returns whether a session was established during it
+func (t *tunnel) disconnect() bool {
+	t.statusLock.Lock()
+	defer t.statusLock.Unlock()
+	if t.state != stateConnected {
+		return false
+	}
+	t.lastActive = time.Now()
+	return true
+}
+
+func (t *tunnel) setState(state tunnelState, err error) {
+	t.statusLock.Lock()
+	defer t.statusLock.Unlock()
+	t.state = state
+	t.retryAt = time.Time{}
+	if state == stateConnected {
+		t.lastActive = time.Now()
+	}
+	if err != nil {
+		t.lastError = err
+	}
+	logrus.WithField("url", t.proxyUrl).WithField("state", state).Info("Tunnel state changed")
+}
+
+func (t *tunnel) setBackingOff(err error, delay time.Duration) {
+	t.setState(stateBackingOff, err)
+	t.statusLock.Lock()
+	defer t.statusLock.Unlock()
+	t.retryAt = time.Now().Add(delay)
+	logrus.WithField("url", t.proxyUrl).WithError(err).Warnf("Retrying connection to proxy in %s", delay.Round(time.Millisecond))
+}
+
+// isConnected returns whether the tunnel currently has a session with the proxy
+func (t *tunnel) isConnected() bool {
+	t.statusLock.RLock()
+	defer t.statusLock.RUnlock()
+	return t.state == stateConnected
+}
+
+// inactiveSince returns the last time the tunnel had a session, or the zero time if it has one right now
+func (t *tunnel) inactiveSince() time.Time {
+	t.statusLock.RLock()
+	defer t.statusLock.RUnlock()
+	if t.state == stateConnected {
+		return time.Time{}
+	}
+	return t.lastActive
+}
+
+func (t *tunnel) status() tunnelStatus {
+	t.statusLock.RLock()
+	defer t.statusLock.RUnlock()
+	status := tunnelStatus{
+		ProxyURL:     t.proxyUrl,
+		State:        t.state,
+		LastActive:   t.lastActive,
+		DialsServed:  atomic.LoadUint64(&t.dialsServed),
+		DialsRefused: atomic.LoadUint64(&t.dialsRefused),
+		Throughput:   newThroughputStatus(t.sent, t.received),
+	}
+	if t.lastError != nil {
+		status.LastError = t.lastError.Error()
+	}
+	if !t.retryAt.IsZero() {
+		retryAt := t.retryAt
+		status.RetryAt = &retryAt
+	}
+	return status
+}
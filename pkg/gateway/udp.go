@@ -0,0 +1,91 @@
+package gateway
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/aiyengar2/portexporter/pkg/datagram"
+)
+
+const (
+	DefaultUDPFlowTimeout = 60 * time.Second
+)
+
+// datagramConn adapts a connected UDP socket to the stream of framed datagrams piped through a tunnel.
+// The flow is closed once no datagrams have been sent or received for the flow timeout
+type datagramConn struct {
+	net.Conn
+
+	timeout    time.Duration
+	lastActive int64
+
+	// pending holds frames received from the socket that have not been read by the tunnel yet
+	pending bytes.Buffer
+	// partial holds bytes written by the tunnel that do not form a complete frame yet
+	partial []byte
+	buf     []byte
+}
+
+func newDatagramConn(conn net.Conn, timeout time.Duration) *datagramConn {
+	if timeout <= 0 {
+		timeout = DefaultUDPFlowTimeout
+	}
+	c := &datagramConn{
+		Conn:    conn,
+		timeout: timeout,
+		buf:     make([]byte, datagram.MaxSize),
+	}
+	c.touch()
+	return c
+}
+
+func (c *datagramConn) touch() {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+}
+
+func (c *datagramConn) idle() bool {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActive))) >= c.timeout
+}
+
+func (c *datagramConn) Read(b []byte) (int, error) {
+	for c.pending.Len() == 0 {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+			return 0, err
+		}
+		n, err := c.Conn.Read(c.buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && !c.idle() {
+				// datagrams are still being sent to the target, so keep the flow open
+				continue
+			}
+			return 0, err
+		}
+		c.touch()
+		if err := datagram.WriteFrame(&c.pending, c.buf[:n]); err != nil {
+			return 0, err
+		}
+	}
+	return c.pending.Read(b)
+}
+
+func (c *datagramConn) Write(b []byte) (int, error) {
+	c.touch()
+	c.partial = append(c.partial, b...)
+	for {
+		d, rest, ok := datagram.NextFrame(c.partial)
+		if !ok {
+			break
+		}
+		if _, err := c.Conn.Write(d); err != nil {
+			return 0, err
+		}
+		c.partial = rest
+	}
+	if len(c.partial) == 0 {
+		// release the memory held by frames that have already been written
+		c.partial = nil
+	}
+	return len(b), nil
+}
@@ -0,0 +1,168 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aiyengar2/portexporter/pkg/config"
+)
+
+// UpstreamProxy configures an HTTP(S) proxy that the gateway must go through to reach proxies.
+// If no URL is configured, the proxy is taken from the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables
+type UpstreamProxy struct {
+	// URL is the address of the upstream proxy (e.g. https://egress.example.com:3128)
+	URL string `yaml:"url,omitempty"`
+	// CredentialsFile is a file containing username:password used to authenticate with the upstream proxy via Basic auth
+	CredentialsFile string `yaml:"credentialsFile,omitempty"`
+	// CaCertFile is a file containing a cacert used to verify the upstream proxy if it is accessed over HTTPS
+	CaCertFile string `yaml:"caCertFile,omitempty"`
+	// NoProxy are hosts that are reached without going through the upstream proxy. Each entry can be
+	// a host name (matching it and its subdomains), a domain prefixed by '.', an IP, a CIDR or '*'
+	NoProxy []string `yaml:"noProxy,omitempty"`
+}
+
+func (p UpstreamProxy) String() string {
+	return fmt.Sprintf("[url=%s,credentialsFile=%s,caCertFile=%s,noProxy=%s]", p.URL, p.CredentialsFile, p.CaCertFile, strings.Join(p.NoProxy, ","))
+}
+
+// upstreamDialer dials addresses by tunneling through an upstream proxy with HTTP CONNECT
+type upstreamDialer struct {
+	UpstreamProxy
+
+	proxyURL  *url.URL
+	tlsConfig *tls.Config
+	dialer    net.Dialer
+}
+
+func newUpstreamDialer(upstream UpstreamProxy) (*upstreamDialer, error) {
+	proxyURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream proxy %s: %s", upstream.URL, err)
+	}
+	d := &upstreamDialer{
+		UpstreamProxy: upstream,
+		proxyURL:      proxyURL,
+		dialer: net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		},
+	}
+	switch proxyURL.Scheme {
+	case "http":
+		if proxyURL.Port() == "" {
+			proxyURL.Host = net.JoinHostPort(proxyURL.Hostname(), "80")
+		}
+	case "https":
+		if proxyURL.Port() == "" {
+			proxyURL.Host = net.JoinHostPort(proxyURL.Hostname(), "443")
+		}
+		d.tlsConfig, err = config.TLSClient{CaCertFile: upstream.CaCertFile}.TLSConfig(proxyURL.Hostname())
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream proxy %s: %s", upstream.URL, err)
+		}
+	default:
+		return nil, fmt.Errorf("invalid upstream proxy %s: scheme must be http or https", upstream.URL)
+	}
+	return d, nil
+}
+
+func (d *upstreamDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.bypass(address) {
+		return d.dialer.DialContext(ctx, network, address)
+	}
+	conn, err := d.dialer.DialContext(ctx, "tcp", d.proxyURL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("unable to reach upstream proxy %s: %s", d.proxyURL.Host, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if d.tlsConfig != nil {
+		tlsConn := tls.Client(conn, d.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("unable to establish TLS with upstream proxy %s: %s", d.proxyURL.Host, err)
+		}
+		conn = tlsConn
+	}
+	if err := d.connect(conn, address); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// connect asks the upstream proxy to tunnel the connection to the address
+func (d *upstreamDialer) connect(conn net.Conn, address string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if d.CredentialsFile != "" {
+		credentials, err := ioutil.ReadFile(d.CredentialsFile)
+		if err != nil {
+			return fmt.Errorf("unable to read upstream proxy credentials from %s: %s", d.CredentialsFile, err)
+		}
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(strings.TrimSpace(string(credentials)))))
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	// the proxy does not send anything past the response until the client speaks, so the buffered reader can be discarded
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return fmt.Errorf("unable to read response of upstream proxy %s: %s", d.proxyURL.Host, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upstream proxy %s refused to connect to %s: %s", d.proxyURL.Host, address, resp.Status)
+	}
+	return nil
+}
+
+// bypass returns whether the address should be reached without going through the upstream proxy
+func (d *upstreamDialer) bypass(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, entry := range d.NoProxy {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+			continue
+		case entry == "*":
+			return true
+		case ip != nil:
+			if _, cidr, err := net.ParseCIDR(entry); err == nil && cidr.Contains(ip) {
+				return true
+			}
+			if entryIP := net.ParseIP(entry); entryIP != nil && entryIP.Equal(ip) {
+				return true
+			}
+		case strings.HasPrefix(entry, "."):
+			if strings.HasSuffix(host, entry) {
+				return true
+			}
+		default:
+			if host == entry || strings.HasSuffix(host, "."+entry) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,9 @@
+package proxy
+
+import "github.com/aiyengar2/portexporter/pkg/config"
+
+// Config represents the configuration of a Proxy
+type Config struct {
+	config.TLSServer
+	UDPForward []UDPForward `yaml:"udpForward,omitempty"`
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"strings"
 
@@ -13,13 +14,34 @@ import (
 
 type proxyHandler struct {
 	rdServer *remotedialer.Server
+	targets  *advertisedTargets
+}
+
+func newProxyHandler() *proxyHandler {
+	authorizer := func(req *http.Request) (string, bool, error) {
+		id := req.Header.Get("X-Proxy-Tunnel-ID")
+		return id, id != "", nil
+	}
+	return &proxyHandler{
+		rdServer: remotedialer.New(authorizer, remotedialer.DefaultErrorWriter),
+		targets:  newAdvertisedTargets(),
+	}
 }
 
 func (h *proxyHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	logrus.Debugf("Received request from host [%s] to url [%s] for method %s", req.RemoteAddr, req.URL, req.Method)
 	if req.URL.Host == "" {
 		if req.URL.Path == "/connect" {
-			h.rdServer.ServeHTTP(rw, req)
+			// the targets advertised by a gateway can only be reached for as long as its session is open. Sessions are
+			// keyed by the tunnel ID that the authorizer accepts
+			w := &connectWriter{
+				ResponseWriter: rw,
+				targets:        h.targets,
+				clientKey:      req.Header.Get("X-Proxy-Tunnel-ID"),
+				header:         req.Header.Get(TunnelTargetsHeader),
+			}
+			defer w.close()
+			h.rdServer.ServeHTTP(w, req)
 			return
 		}
 		http.Error(rw, "proxy only supports '/connect'", http.StatusNotFound)
@@ -88,6 +110,48 @@ func (h *proxyHandler) handleHTTP(rw http.ResponseWriter, req *http.Request) {
 	io.Copy(rw, resp.Body)
 }
 
+// getDialer returns a dialer that connects to the host of the request through the tunnel of the gateway it belongs to
 func (h *proxyHandler) getDialer(req *http.Request) remotedialer.Dialer {
-	return h.rdServer.Dialer(strings.Split(req.Host, ":")[0])
+	hostname, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		hostname = req.Host
+	}
+	clientKey, virtualHost := h.resolveHost(hostname)
+	dialer := h.rdServer.Dialer(clientKey)
+	if virtualHost == "" {
+		return dialer
+	}
+	if !h.targets.has(clientKey, virtualHost) {
+		return func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, fmt.Errorf("gateway %s does not advertise a target named %s", clientKey, virtualHost)
+		}
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		_, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		return dialer(ctx, network, net.JoinHostPort(virtualHost, port))
+	}
+}
+
+// resolveHost returns the tunnel ID of the gateway that serves a hostname. If the hostname does not match a tunnel ID,
+// it is treated as a virtual host of the form <name>.<tunnel ID> (e.g. node-exporter.10.0.0.7), where <name> is a
+// target advertised by the gateway that it resolves to an address on its own network
+func (h *proxyHandler) resolveHost(hostname string) (clientKey string, virtualHost string) {
+	if h.rdServer.HasSession(hostname) {
+		return hostname, ""
+	}
+	for i := strings.Index(hostname, "."); i >= 0; {
+		name, clientKey := hostname[:i], hostname[i+1:]
+		if h.rdServer.HasSession(clientKey) {
+			return clientKey, name
+		}
+		next := strings.Index(clientKey, ".")
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return hostname, ""
 }
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher/remotedialer"
+)
+
+const testTunnelID = "10.0.0.7"
+
+// connectGateway opens a session to the proxy as a gateway that advertises the provided targets, returning the
+// addresses that the gateway is asked to dial and a function that closes the session
+func connectGateway(t *testing.T, h *proxyHandler, url, targets string) (chan string, func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	dialed := make(chan string, 10)
+	localDialer := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed <- address
+		conn, _ := net.Pipe()
+		return conn, nil
+	}
+	headers := http.Header{
+		"X-Proxy-Tunnel-ID": []string{testTunnelID},
+		TunnelTargetsHeader: []string{targets},
+	}
+	allowAll := func(proto, address string) bool { return true }
+	go remotedialer.ConnectToProxyWithDialer(ctx, url, headers, allowAll, nil, localDialer, nil)
+	waitFor(t, func() bool { return h.rdServer.HasSession(testTunnelID) })
+	return dialed, func() {
+		cancel()
+		waitFor(t, func() bool { return !h.rdServer.HasSession(testTunnelID) })
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProxyHandlerVirtualHosts(t *testing.T) {
+	h := newProxyHandler()
+	server := httptest.NewServer(h)
+	defer server.Close()
+	dialed, disconnect := connectGateway(t, h, "ws://"+server.Listener.Addr().String()+"/connect", "web, db")
+
+	// connect requests that remotedialer rejects must not change the targets of the gateway
+	for _, header := range []http.Header{
+		{"X-Proxy-Tunnel-ID": []string{testTunnelID}, TunnelTargetsHeader: []string{"other"}},
+		{TunnelTargetsHeader: []string{"other"}},
+	} {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/connect", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = header
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode < http.StatusBadRequest {
+			t.Fatalf("connect request without an upgrade returned %d", resp.StatusCode)
+		}
+	}
+
+	tests := []struct {
+		host            string
+		wantClientKey   string
+		wantVirtualHost string
+		// wantDialed is the address that the gateway is asked to dial, or empty if the dial must be refused
+		wantDialed string
+	}{
+		{
+			host:          testTunnelID + ":9100",
+			wantClientKey: testTunnelID,
+			wantDialed:    testTunnelID + ":9100",
+		},
+		{
+			host:            "web." + testTunnelID + ":8080",
+			wantClientKey:   testTunnelID,
+			wantVirtualHost: "web",
+			wantDialed:      "web:8080",
+		},
+		{
+			host:            "db." + testTunnelID + ":5432",
+			wantClientKey:   testTunnelID,
+			wantVirtualHost: "db",
+			wantDialed:      "db:5432",
+		},
+		{
+			host:            "other." + testTunnelID + ":80",
+			wantClientKey:   testTunnelID,
+			wantVirtualHost: "other",
+		},
+		{
+			host:            "a.web." + testTunnelID + ":80",
+			wantClientKey:   testTunnelID,
+			wantVirtualHost: "a.web",
+		},
+		{
+			host:          "web.10.0.0.8:80",
+			wantClientKey: "web.10.0.0.8",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			hostname := tt.host[:strings.LastIndex(tt.host, ":")]
+			clientKey, virtualHost := h.resolveHost(hostname)
+			if clientKey != tt.wantClientKey || virtualHost != tt.wantVirtualHost {
+				t.Errorf("resolveHost(%s) = %s, %s, want %s, %s", hostname, clientKey, virtualHost, tt.wantClientKey, tt.wantVirtualHost)
+			}
+			conn, err := h.getDialer(&http.Request{Host: tt.host})(context.Background(), "tcp", tt.host)
+			if tt.wantDialed == "" {
+				if err == nil {
+					conn.Close()
+					t.Fatalf("getDialer(%s) dialed, want error", tt.host)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getDialer(%s) failed: %s", tt.host, err)
+			}
+			// the connection is left open until the session closes, since remotedialer races closing a connection
+			// from both ends
+			select {
+			case address := <-dialed:
+				if address != tt.wantDialed {
+					t.Errorf("getDialer(%s) dialed %s, want %s", tt.host, address, tt.wantDialed)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("getDialer(%s) did not reach the gateway", tt.host)
+			}
+		})
+	}
+
+	disconnect()
+	if h.targets.has(testTunnelID, "web") {
+		t.Error("targets of the gateway are still advertised after its session closed")
+	}
+}
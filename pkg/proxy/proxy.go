@@ -3,30 +3,35 @@ package proxy
 import (
 	"context"
 	"crypto/tls"
+	"net"
 	"net/http"
 	"time"
 
-	"github.com/aiyengar2/portexporter/pkg/config"
-	"github.com/rancher/remotedialer"
 	"github.com/sirupsen/logrus"
 )
 
 type proxyServer struct {
 	http.Server
 
-	useTLS bool
+	useTLS        bool
+	listener      net.Listener
+	udpForwarders []*udpForwarder
 }
 
-func NewServer(listenAddr string, config config.TLSServer) *proxyServer {
-	s := &proxyServer{}
-
-	if config.CertFile != "" && config.KeyFile != "" {
-		s.useTLS = true
+func NewServer(listenAddr string, config Config) (*proxyServer, error) {
+	s := &proxyServer{
+		useTLS: config.Enabled(),
+	}
+	// the listener closes sessions of gateways whose client certificates are revoked
+	var err error
+	s.listener, err = config.Listen(listenAddr)
+	if err != nil {
+		return nil, err
 	}
 
-	authorizer := func(req *http.Request) (string, bool, error) {
-		id := req.Header.Get("X-Proxy-Tunnel-ID")
-		return id, id != "", nil
+	handler := newProxyHandler()
+	for _, forward := range config.UDPForward {
+		s.udpForwarders = append(s.udpForwarders, newUDPForwarder(forward, handler.rdServer))
 	}
 	s.Server = http.Server{
 		Addr:         listenAddr,
@@ -35,27 +40,26 @@ func NewServer(listenAddr string, config config.TLSServer) *proxyServer {
 		IdleTimeout:  time.Second * 60,
 		// disable HTTP/2 support
 		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
-		Handler: &proxyHandler{
-			rdServer: remotedialer.New(authorizer, remotedialer.DefaultErrorWriter),
-		},
-		TLSConfig: config.TLSConfig(listenAddr),
+		Handler:      handler,
 	}
 
-	return s
+	return s, nil
 }
 
 func (s *proxyServer) Start(ctx context.Context) error {
+	for _, f := range s.udpForwarders {
+		if err := f.Start(ctx); err != nil {
+			return err
+		}
+	}
 	go func() {
 		if !s.useTLS {
 			logrus.Infof("Listening for HTTP connections on %s", s.Addr)
-			if err := s.ListenAndServe(); err != nil {
-				logrus.Error(err)
-			}
 		} else {
 			logrus.Infof("Listening for TLS connections on %s", s.Addr)
-			if err := s.ListenAndServeTLS("", ""); err != nil {
-				logrus.Error(err)
-			}
+		}
+		if err := s.Serve(s.listener); err != nil {
+			logrus.Error(err)
 		}
 	}()
 	<-ctx.Done()
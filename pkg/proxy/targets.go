@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	// TunnelTargetsHeader is the header that gateways use to advertise the names of their targets
+	TunnelTargetsHeader = "X-Proxy-Tunnel-Targets"
+)
+
+// advertisedTargets tracks the names of the targets that each session of a gateway advertises
+type advertisedTargets struct {
+	lock sync.RWMutex
+	// sessions are the targets of the open sessions of each gateway, oldest first
+	sessions map[string][]*targetNames
+}
+
+// targetNames are the names of the targets advertised by a single session
+type targetNames struct {
+	names map[string]bool
+}
+
+func newAdvertisedTargets() *advertisedTargets {
+	return &advertisedTargets{
+		sessions: make(map[string][]*targetNames),
+	}
+}
+
+// add records the targets advertised by a session of a gateway, returning a function that removes them once the
+// session is closed
+func (a *advertisedTargets) add(clientKey, header string) func() {
+	targets := &targetNames{names: make(map[string]bool)}
+	for _, name := range strings.Split(header, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			targets.names[name] = true
+		}
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.sessions[clientKey] = append(a.sessions[clientKey], targets)
+	return func() {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		var remaining []*targetNames
+		for _, t := range a.sessions[clientKey] {
+			if t != targets {
+				remaining = append(remaining, t)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(a.sessions, clientKey)
+			return
+		}
+		a.sessions[clientKey] = remaining
+	}
+}
+
+// has returns whether a gateway advertised a target with the provided name. Like remotedialer, which dials through
+// the oldest session of a gateway, only the targets of its oldest session are considered
+func (a *advertisedTargets) has(clientKey, name string) bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	sessions := a.sessions[clientKey]
+	return len(sessions) > 0 && sessions[0].names[name]
+}
+
+// connectWriter records the targets advertised by a connect request once remotedialer has authorized it and hijacks
+// its connection to upgrade it to a session, so that requests that are rejected cannot change the targets of a gateway
+type connectWriter struct {
+	http.ResponseWriter
+
+	targets   *advertisedTargets
+	clientKey string
+	header    string
+	remove    func()
+}
+
+func (w *connectWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil && w.remove == nil {
+		w.remove = w.targets.add(w.clientKey, w.header)
+	}
+	return conn, rw, err
+}
+
+// close removes the targets of the session, if one was opened
+func (w *connectWriter) close() {
+	if w.remove != nil {
+		w.remove()
+	}
+}
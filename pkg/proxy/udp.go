@@ -0,0 +1,260 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aiyengar2/portexporter/pkg/datagram"
+	"github.com/rancher/remotedialer"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultUDPFlowTimeout = 60 * time.Second
+
+	// maxPendingDatagrams is how many datagrams from a client are queued while its flow is being dialed
+	maxPendingDatagrams = 64
+)
+
+// UDPForward forwards datagrams received on a local UDP address to an address on the network of a Gateway
+type UDPForward struct {
+	// Listen is the local UDP address to receive datagrams on
+	Listen string `yaml:"listen,omitempty"`
+	// TunnelID identifies the gateway that datagrams are forwarded through
+	TunnelID string `yaml:"tunnelID,omitempty"`
+	// Target is the UDP address to forward datagrams to on the network of the gateway
+	Target string `yaml:"target,omitempty"`
+	// FlowTimeout is how long a flow from a single client can go without any datagrams before it is closed
+	FlowTimeout time.Duration `yaml:"flowTimeout,omitempty"`
+}
+
+// ParseUDPForward parses a UDP forward of the form LISTEN=TUNNEL_ID/TARGET (e.g. :8125=10.0.0.7/127.0.0.1:8125)
+func ParseUDPForward(forward string) (UDPForward, error) {
+	parts := strings.SplitN(forward, "=", 2)
+	if len(parts) != 2 {
+		return UDPForward{}, fmt.Errorf("invalid UDP forward %s: expected LISTEN=TUNNEL_ID/TARGET", forward)
+	}
+	destination := strings.SplitN(parts[1], "/", 2)
+	if len(destination) != 2 || destination[0] == "" || destination[1] == "" {
+		return UDPForward{}, fmt.Errorf("invalid UDP forward %s: expected LISTEN=TUNNEL_ID/TARGET", forward)
+	}
+	return UDPForward{
+		Listen:   parts[0],
+		TunnelID: destination[0],
+		Target:   destination[1],
+	}, nil
+}
+
+func (f UDPForward) String() string {
+	return fmt.Sprintf("[listen=%s,tunnelID=%s,target=%s]", f.Listen, f.TunnelID, f.Target)
+}
+
+// udpForwarder tunnels the datagrams of each client that sends to a UDP address as a separate flow
+type udpForwarder struct {
+	UDPForward
+
+	dial remotedialer.Dialer
+
+	flowsLock sync.Mutex
+	flows     map[string]*udpFlow
+}
+
+// udpFlow is the tunneled connection for datagrams from a single client
+type udpFlow struct {
+	// conn is nil until the flow has been dialed and its pending datagrams have been forwarded
+	conn       net.Conn
+	lastActive time.Time
+	// pending are the datagrams received while the flow is being dialed, in the order they were received
+	pending [][]byte
+	// dropped is the number of datagrams discarded because too many were pending
+	dropped int
+}
+
+func newUDPForwarder(forward UDPForward, rdServer *remotedialer.Server) *udpForwarder {
+	if forward.FlowTimeout <= 0 {
+		forward.FlowTimeout = DefaultUDPFlowTimeout
+	}
+	return &udpForwarder{
+		UDPForward: forward,
+		dial:       rdServer.Dialer(forward.TunnelID),
+		flows:      make(map[string]*udpFlow),
+	}
+}
+
+func (f *udpForwarder) Start(ctx context.Context) error {
+	pc, err := net.ListenPacket("udp", f.Listen)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Forwarding UDP datagrams on %s to %s through tunnel %s", f.Listen, f.Target, f.TunnelID)
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+	}()
+	go f.expireFlows(ctx)
+	go f.serve(ctx, pc)
+	return nil
+}
+
+// serve forwards the datagrams received on pc until it is closed
+func (f *udpForwarder) serve(ctx context.Context, pc net.PacketConn) {
+	buf := make([]byte, datagram.MaxSize)
+	for {
+		n, src, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				logrus.Errorf("unable to read from UDP forward %s: %s", f, err)
+			}
+			return
+		}
+		if flow := f.getFlow(ctx, pc, src, buf[:n]); flow != nil {
+			f.forward(src, flow, buf[:n])
+		}
+	}
+}
+
+func (f *udpForwarder) forward(src net.Addr, flow *udpFlow, payload []byte) {
+	if err := datagram.WriteFrame(flow.conn, payload); err != nil {
+		logrus.Warnf("unable to forward datagram from %s to %s through tunnel %s: %s", src, f.Target, f.TunnelID, err)
+		f.closeFlow(src.String(), flow)
+	}
+}
+
+// getFlow returns the flow for datagrams from src if it is ready to forward a datagram. Otherwise, the datagram is
+// queued until the flow has been dialed, which happens once per flow in the background so that datagrams of other
+// flows are not held up
+func (f *udpForwarder) getFlow(ctx context.Context, pc net.PacketConn, src net.Addr, payload []byte) *udpFlow {
+	key := src.String()
+	f.flowsLock.Lock()
+	defer f.flowsLock.Unlock()
+	flow, ok := f.flows[key]
+	if ok && flow.conn != nil {
+		flow.lastActive = time.Now()
+		return flow
+	}
+	if !ok {
+		flow = &udpFlow{lastActive: time.Now()}
+		f.flows[key] = flow
+		go f.dialFlow(ctx, pc, src, flow)
+	}
+	if len(flow.pending) >= maxPendingDatagrams {
+		flow.dropped++
+		return nil
+	}
+	flow.pending = append(flow.pending, append([]byte{}, payload...))
+	return nil
+}
+
+// dialFlow dials the target through the tunnel for a new flow, forwards the datagrams that were queued in the meantime
+// and returns datagrams from the target to the client until the flow is closed
+func (f *udpForwarder) dialFlow(ctx context.Context, pc net.PacketConn, src net.Addr, flow *udpFlow) {
+	key := src.String()
+	dialCtx, cancel := context.WithTimeout(ctx, f.FlowTimeout)
+	conn, err := f.dial(dialCtx, "udp", f.Target)
+	cancel()
+	if err != nil {
+		f.flowsLock.Lock()
+		if f.flows[key] == flow {
+			delete(f.flows, key)
+		}
+		dropped := len(flow.pending) + flow.dropped
+		f.flowsLock.Unlock()
+		logrus.Warnf("unable to forward %d datagrams from %s to %s through tunnel %s: %s", dropped, src, f.Target, f.TunnelID, err)
+		return
+	}
+	// forward the pending datagrams in order; the flow only becomes ready once none are left, so that later datagrams
+	// cannot overtake them
+	for {
+		f.flowsLock.Lock()
+		if f.flows[key] != flow {
+			f.flowsLock.Unlock()
+			conn.Close()
+			return
+		}
+		pending, dropped := flow.pending, flow.dropped
+		flow.pending, flow.dropped = nil, 0
+		if len(pending) == 0 {
+			flow.conn = conn
+		}
+		f.flowsLock.Unlock()
+		if dropped > 0 {
+			logrus.Warnf("dropped %d datagrams from %s to %s while dialing through tunnel %s", dropped, src, f.Target, f.TunnelID)
+		}
+		if len(pending) == 0 {
+			break
+		}
+		for _, payload := range pending {
+			if err := datagram.WriteFrame(conn, payload); err != nil {
+				logrus.Warnf("unable to forward datagram from %s to %s through tunnel %s: %s", src, f.Target, f.TunnelID, err)
+				f.flowsLock.Lock()
+				if f.flows[key] == flow {
+					delete(f.flows, key)
+				}
+				f.flowsLock.Unlock()
+				conn.Close()
+				return
+			}
+		}
+	}
+
+	// return datagrams from the target to the client
+	defer f.closeFlow(key, flow)
+	buf := make([]byte, datagram.MaxSize)
+	for {
+		n, err := datagram.ReadFrame(conn, buf)
+		if err != nil {
+			return
+		}
+		f.flowsLock.Lock()
+		flow.lastActive = time.Now()
+		f.flowsLock.Unlock()
+		if _, err := pc.WriteTo(buf[:n], src); err != nil {
+			return
+		}
+	}
+}
+
+func (f *udpForwarder) closeFlow(key string, flow *udpFlow) {
+	f.flowsLock.Lock()
+	defer f.flowsLock.Unlock()
+	if f.flows[key] == flow {
+		delete(f.flows, key)
+	}
+	if flow.conn != nil {
+		flow.conn.Close()
+	}
+}
+
+// expireFlows closes flows that have not sent or received any datagrams within the flow timeout. Flows that are still
+// being dialed are left to the dial, which gives up after the flow timeout
+func (f *udpForwarder) expireFlows(ctx context.Context) {
+	ticker := time.NewTicker(f.FlowTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			f.flowsLock.Lock()
+			for key, flow := range f.flows {
+				if flow.conn != nil {
+					flow.conn.Close()
+				}
+				delete(f.flows, key)
+			}
+			f.flowsLock.Unlock()
+			return
+		case <-ticker.C:
+		}
+		f.flowsLock.Lock()
+		for key, flow := range f.flows {
+			if flow.conn != nil && time.Since(flow.lastActive) >= f.FlowTimeout {
+				flow.conn.Close()
+				delete(f.flows, key)
+			}
+		}
+		f.flowsLock.Unlock()
+	}
+}
@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aiyengar2/portexporter/pkg/datagram"
+)
+
+// testTunnel stands in for the tunnel of a gateway, handing out one end of a pipe per dial once it is released
+type testTunnel struct {
+	dials   int32
+	release chan struct{}
+	err     error
+	conns   chan net.Conn
+}
+
+func newTestTunnel() *testTunnel {
+	return &testTunnel{
+		release: make(chan struct{}),
+		conns:   make(chan net.Conn, 10),
+	}
+}
+
+func (t *testTunnel) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	atomic.AddInt32(&t.dials, 1)
+	select {
+	case <-t.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if t.err != nil {
+		return nil, t.err
+	}
+	proxyEnd, gatewayEnd := net.Pipe()
+	t.conns <- gatewayEnd
+	return proxyEnd, nil
+}
+
+func startTestForwarder(t *testing.T, tunnel *testTunnel) (*udpForwarder, net.Conn) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	f := &udpForwarder{
+		UDPForward: UDPForward{Target: "127.0.0.1:8125", FlowTimeout: time.Minute},
+		dial:       tunnel.dial,
+		flows:      make(map[string]*udpFlow),
+	}
+	go f.serve(ctx, pc)
+	client, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return f, client
+}
+
+// waitForPending waits until the flow of a client has queued or dropped n datagrams
+func waitForPending(t *testing.T, f *udpForwarder, client net.Conn, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		f.flowsLock.Lock()
+		flow, ok := f.flows[client.LocalAddr().String()]
+		queued := ok && len(flow.pending)+flow.dropped == n
+		f.flowsLock.Unlock()
+		if queued {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d pending datagrams", n)
+}
+
+func send(t *testing.T, client net.Conn, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		if _, err := fmt.Fprintf(client, "%d", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func expectFrames(t *testing.T, conn net.Conn, from, to int) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, datagram.MaxSize)
+	for i := from; i < to; i++ {
+		n, err := datagram.ReadFrame(conn, buf)
+		if err != nil {
+			t.Fatalf("unable to read datagram %d: %s", i, err)
+		}
+		if got, want := string(buf[:n]), fmt.Sprint(i); got != want {
+			t.Fatalf("datagram = %s, want %s", got, want)
+		}
+	}
+}
+
+func TestUDPForwarderDialsOncePerFlow(t *testing.T) {
+	tests := []struct {
+		name string
+		// sent is how many datagrams the client sends while its flow is being dialed
+		sent int
+		// forwarded is how many of those are forwarded once the flow is dialed
+		forwarded int
+	}{
+		{
+			name:      "single datagram",
+			sent:      1,
+			forwarded: 1,
+		},
+		{
+			name:      "burst",
+			sent:      20,
+			forwarded: 20,
+		},
+		{
+			name:      "burst beyond the queue",
+			sent:      maxPendingDatagrams + 10,
+			forwarded: maxPendingDatagrams,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tunnel := newTestTunnel()
+			f, client := startTestForwarder(t, tunnel)
+
+			send(t, client, 0, tt.sent)
+			waitForPending(t, f, client, tt.sent)
+			close(tunnel.release)
+			gatewayEnd := <-tunnel.conns
+			defer gatewayEnd.Close()
+			expectFrames(t, gatewayEnd, 0, tt.forwarded)
+
+			// datagrams sent once the flow is ready follow the queued ones through the same connection
+			send(t, client, tt.sent, tt.sent+5)
+			expectFrames(t, gatewayEnd, tt.sent, tt.sent+5)
+			if dials := atomic.LoadInt32(&tunnel.dials); dials != 1 {
+				t.Errorf("dialed %d times, want 1", dials)
+			}
+		})
+	}
+}
+
+func TestUDPForwarderRedialsFailedFlow(t *testing.T) {
+	tunnel := newTestTunnel()
+	tunnel.err = fmt.Errorf("no session")
+	f, client := startTestForwarder(t, tunnel)
+
+	send(t, client, 0, 3)
+	waitForPending(t, f, client, 3)
+	close(tunnel.release)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		f.flowsLock.Lock()
+		flows := len(f.flows)
+		f.flowsLock.Unlock()
+		if flows == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the failed flow to be removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	send(t, client, 3, 4)
+	deadline = time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&tunnel.dials) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("dialed %d times, want 2", atomic.LoadInt32(&tunnel.dials))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,335 @@
+package redirect
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aiyengar2/portexporter/pkg/config"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	adminRedirectsPath = "/redirects"
+	adminRedirectPath  = "/redirects/{scheme}/{host}"
+
+	// maxAdminRequestSize is the largest request body accepted by the admin API
+	maxAdminRequestSize = 1 << 20
+)
+
+// adminServer serves an API that lists, gets, creates, updates and deletes the redirects of a redirect server
+type adminServer struct {
+	*http.Server
+
+	router    *router
+	useTLS    bool
+	listener  net.Listener
+	tokenFile string
+	// persistFile is the configuration file that changes are written back to, if any
+	persistFile string
+	// credentialsDir is the directory that redirects created or updated through the API can read files from, if any
+	credentialsDir string
+	// lock serializes changes so that they are persisted in the order that they are made
+	lock sync.Mutex
+}
+
+// redirectState is a redirect along with its status, as returned by the admin API
+type redirectState struct {
+	Redirect *Redirect      `yaml:"redirect"`
+	Status   redirectStatus `yaml:"status"`
+}
+
+type redirectStatus struct {
+	// CredentialsReloaded is when the credentials of the redirect were last read from their files
+	CredentialsReloaded string `yaml:"credentialsReloaded,omitempty"`
+	// LastError is the last error reaching the upstream of the redirect
+	LastError     string `yaml:"lastError,omitempty"`
+	LastErrorTime string `yaml:"lastErrorTime,omitempty"`
+}
+
+// NewAdminServer returns a server for the admin API of a redirect server, which serves TLS if tlsServer is enabled.
+// Requests must carry the token in tokenFile as a bearer token. If persistFile is set, the redirects are written back
+// to it after every change. Redirects can only reference files within credentialsDir, or none if it is unset
+func NewAdminServer(listenAddr, tokenFile, persistFile, credentialsDir string, tlsServer config.TLSServer, server *redirectServer) (*adminServer, error) {
+	s := &adminServer{
+		router:         server.router,
+		useTLS:         tlsServer.Enabled(),
+		tokenFile:      tokenFile,
+		persistFile:    persistFile,
+		credentialsDir: credentialsDir,
+	}
+	var err error
+	s.listener, err = tlsServer.Listen(listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	r := mux.NewRouter()
+	r.HandleFunc(adminRedirectsPath, s.list).Methods(http.MethodGet)
+	r.HandleFunc(adminRedirectsPath, s.create).Methods(http.MethodPost)
+	r.HandleFunc(adminRedirectPath, s.get).Methods(http.MethodGet)
+	r.HandleFunc(adminRedirectPath, s.update).Methods(http.MethodPut)
+	r.HandleFunc(adminRedirectPath, s.delete).Methods(http.MethodDelete)
+	s.Server = &http.Server{
+		Addr:         listenAddr,
+		WriteTimeout: time.Second * 15,
+		ReadTimeout:  time.Second * 15,
+		IdleTimeout:  time.Second * 60,
+		Handler:      s.authenticate(r),
+	}
+	return s, nil
+}
+
+func (s *adminServer) Start(ctx context.Context) {
+	if !s.useTLS {
+		logrus.Infof("Serving the admin API on http://%s", s.Addr)
+	} else {
+		logrus.Infof("Serving the admin API on https://%s", s.Addr)
+	}
+	go func() {
+		if err := s.Serve(s.listener); err != nil && err != http.ErrServerClosed {
+			logrus.Error(err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		s.Shutdown(context.Background())
+	}()
+}
+
+// authenticate only passes on requests that carry the token in the token file
+func (s *adminServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		token, err := ioutil.ReadFile(s.tokenFile)
+		token = bytes.TrimSpace(token)
+		if err != nil || len(token) == 0 {
+			logrus.Errorf("unable to read admin token from %s: %v", s.tokenFile, err)
+			http.Error(rw, "admin token is unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		expected := append([]byte("Bearer "), token...)
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), expected) != 1 {
+			rw.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+func (s *adminServer) list(rw http.ResponseWriter, req *http.Request) {
+	states := []redirectState{}
+	for _, redirect := range s.router.Redirects() {
+		states = append(states, stateOf(redirect))
+	}
+	writeYAML(rw, http.StatusOK, states)
+}
+
+func (s *adminServer) get(rw http.ResponseWriter, req *http.Request) {
+	address := addressOf(req)
+	redirect := s.router.Redirect(address)
+	if redirect == nil {
+		http.Error(rw, fmt.Sprintf("redirect address %s has not been registered", address), http.StatusNotFound)
+		return
+	}
+	writeYAML(rw, http.StatusOK, stateOf(redirect))
+}
+
+func (s *adminServer) create(rw http.ResponseWriter, req *http.Request) {
+	redirect, err := readRedirect(rw, req)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if redirect.Address == "" {
+		http.Error(rw, "redirect must have an address", http.StatusBadRequest)
+		return
+	}
+	if err := s.checkFiles(redirect); err != nil {
+		http.Error(rw, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.router.Redirect(redirect.Address) != nil {
+		http.Error(rw, fmt.Sprintf("redirect address %s has already been registered", redirect.Address), http.StatusConflict)
+		return
+	}
+	if err := s.router.RegisterHandler(redirect.Address, redirect); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logrus.Infof("Added redirect %s through the admin API", redirect)
+	s.persist(rw, http.StatusCreated, redirect)
+}
+
+func (s *adminServer) update(rw http.ResponseWriter, req *http.Request) {
+	address := addressOf(req)
+	redirect, err := readRedirect(rw, req)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if redirect.Address == "" {
+		redirect.Address = address
+	}
+	if redirect.Address != address {
+		http.Error(rw, fmt.Sprintf("cannot change the address of redirect %s to %s", address, redirect.Address), http.StatusBadRequest)
+		return
+	}
+	if err := s.checkFiles(redirect); err != nil {
+		http.Error(rw, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	previous := s.router.Redirect(address)
+	if previous == nil {
+		http.Error(rw, fmt.Sprintf("redirect address %s has not been registered", address), http.StatusNotFound)
+		return
+	}
+	if err := s.router.UpdateHandler(address, redirect); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logrus.Infof("Updated redirect %s to %s through the admin API", previous, redirect)
+	s.persist(rw, http.StatusOK, redirect)
+}
+
+func (s *adminServer) delete(rw http.ResponseWriter, req *http.Request) {
+	address := addressOf(req)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	redirect := s.router.Redirect(address)
+	if redirect == nil {
+		http.Error(rw, fmt.Sprintf("redirect address %s has not been registered", address), http.StatusNotFound)
+		return
+	}
+	if err := s.router.UnregisterHandler(address); err != nil {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	logrus.Infof("Removed redirect %s through the admin API", redirect)
+	s.persist(rw, http.StatusNoContent, nil)
+}
+
+// checkFiles returns an error if a redirect references a file outside of the credentials directory, since the contents
+// of credential files are sent to the upstream of the redirect
+func (s *adminServer) checkFiles(redirect *Redirect) error {
+	files := append(redirect.CredentialFiles(), redirect.CaCertFile, redirect.CertFile, redirect.KeyFile)
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		if s.credentialsDir == "" {
+			return fmt.Errorf("redirects created through the admin API cannot reference files such as %s", file)
+		}
+		rel, err := filepath.Rel(s.credentialsDir, file)
+		if err != nil || !filepath.IsAbs(file) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("file %s is not within %s", file, s.credentialsDir)
+		}
+	}
+	return nil
+}
+
+// persist writes the redirects back to the persist file, if any, and responds with the changed redirect. The caller
+// must hold the lock
+func (s *adminServer) persist(rw http.ResponseWriter, status int, redirect *Redirect) {
+	if s.persistFile != "" {
+		if err := s.writeConfig(); err != nil {
+			logrus.Errorf("unable to persist redirects to %s: %s", s.persistFile, err)
+			http.Error(rw, fmt.Sprintf("redirects were changed but could not be persisted to %s", s.persistFile), http.StatusInternalServerError)
+			return
+		}
+	}
+	if redirect == nil {
+		rw.WriteHeader(status)
+		return
+	}
+	writeYAML(rw, status, stateOf(redirect))
+}
+
+// writeConfig replaces the persist file with the registered redirects, writing to a temporary file first so that the
+// file is never seen partially written
+func (s *adminServer) writeConfig() error {
+	configBytes, err := yaml.Marshal(struct {
+		Redirect []*Redirect `yaml:"redirect,omitempty"`
+	}{
+		Redirect: s.router.Redirects(),
+	})
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.persistFile), filepath.Base(s.persistFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(configBytes); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.persistFile)
+}
+
+// addressOf returns the address of the redirect that a request to the admin API refers to
+func addressOf(req *http.Request) string {
+	vars := mux.Vars(req)
+	return fmt.Sprintf("%s://%s", vars["scheme"], vars["host"])
+}
+
+// readRedirect parses a redirect from the YAML (or JSON) body of a request
+func readRedirect(rw http.ResponseWriter, req *http.Request) (*Redirect, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(rw, req.Body, maxAdminRequestSize))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read redirect: %s", err)
+	}
+	redirect := &Redirect{}
+	if err := yaml.UnmarshalStrict(body, redirect); err != nil {
+		return nil, fmt.Errorf("unable to parse redirect: %s", err)
+	}
+	return redirect, nil
+}
+
+func stateOf(redirect *Redirect) redirectState {
+	state := redirectState{Redirect: redirect}
+	if reloaded := redirect.CredentialsReloaded(); !reloaded.IsZero() {
+		state.Status.CredentialsReloaded = reloaded.Format(time.RFC3339)
+	}
+	if errorTime, err := redirect.upstreamError(); err != nil {
+		state.Status.LastError = err.Error()
+		state.Status.LastErrorTime = errorTime.Format(time.RFC3339)
+	}
+	return state
+}
+
+func writeYAML(rw http.ResponseWriter, status int, v interface{}) {
+	out, err := yaml.Marshal(v)
+	if err != nil {
+		logrus.Errorf("unable to encode response: %s", err)
+		http.Error(rw, "unable to encode response", http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/yaml")
+	rw.WriteHeader(status)
+	rw.Write(out)
+}
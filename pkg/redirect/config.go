@@ -19,6 +19,10 @@ func Load(configFile string) (Config, error) {
 	if err != nil {
 		return Config{}, err
 	}
+	return parse(configBytes)
+}
+
+func parse(configBytes []byte) (Config, error) {
 	var opts Config
 	return opts, yaml.Unmarshal(configBytes, &opts)
 }
@@ -5,21 +5,35 @@ import (
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
+	"sync"
 	"time"
 
 	"github.com/aiyengar2/portexporter/pkg/config"
-	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
 )
 
 type Redirect struct {
-	config.HTTP
-	config.TLSClient
-	Address string `yaml:"address,omitempty"`
+	config.HTTP      `yaml:"http,omitempty"`
+	config.TLSClient `yaml:"tlsclient,omitempty"`
+	Address          string `yaml:"address,omitempty"`
+
+	lastError     error
+	lastErrorTime time.Time
+	errorLock     sync.Mutex
 }
 
-func (r Redirect) ToHandler() http.Handler {
+func (r *Redirect) ToHandler() (http.Handler, error) {
+	if err := r.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid HTTP configuration for redirect %s: %s", r.Address, err)
+	}
+	tlsConfig, err := r.TLSConfig(r.serverName())
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS configuration for redirect %s: %s", r.Address, err)
+	}
 	return &httputil.ReverseProxy{
-		Director: r.HTTP.Director,
+		Director:     r.Director,
+		ErrorHandler: r.proxyError,
 		Transport: &http.Transport{
 			Proxy: http.ProxyFromEnvironment,
 			DialContext: (&net.Dialer{
@@ -31,27 +45,39 @@ func (r Redirect) ToHandler() http.Handler {
 			IdleConnTimeout:       90 * time.Second,
 			TLSHandshakeTimeout:   10 * time.Second,
 			ExpectContinueTimeout: 1 * time.Second,
-			TLSClientConfig:       r.TLSConfig(r.Address),
+			TLSClientConfig:       tlsConfig,
 		},
-	}
+	}, nil
 }
 
-func (r Redirect) RestartWatcher() (*fsnotify.Watcher, error) {
-	w, err := fsnotify.NewWatcher()
-	if err != nil {
-		return nil, err
+// serverName returns the host that the certificate of the upstream is verified against
+func (r *Redirect) serverName() string {
+	u, err := url.Parse(r.Address)
+	if err != nil || u.Host == "" {
+		return r.Address
 	}
-	for _, path := range []string{r.TokenFile, r.CaCertFile} {
-		if path == "" {
-			continue
-		}
-		if err := w.Add(path); err != nil {
-			return nil, err
-		}
-	}
-	return w, nil
+	return u.Hostname()
+}
+
+// proxyError records an error reaching the upstream of the redirect and responds with a 502 Bad Gateway, like the
+// default error handler of httputil.ReverseProxy
+func (r *Redirect) proxyError(rw http.ResponseWriter, req *http.Request, err error) {
+	logrus.Errorf("unable to proxy request to %s: %s", req.URL, err)
+	r.errorLock.Lock()
+	r.lastError = err
+	r.lastErrorTime = time.Now()
+	r.errorLock.Unlock()
+	rw.WriteHeader(http.StatusBadGateway)
+}
+
+// upstreamError returns when the last error reaching the upstream of the redirect happened and the error, or nil if
+// none has
+func (r *Redirect) upstreamError() (time.Time, error) {
+	r.errorLock.Lock()
+	defer r.errorLock.Unlock()
+	return r.lastErrorTime, r.lastError
 }
 
-func (r Redirect) String() string {
-	return fmt.Sprintf("[address=%s,http=%s,tls=%s]", r.Address, r.HTTP, r.TLSClient)
+func (r *Redirect) String() string {
+	return fmt.Sprintf("[address=%s,http=%s,tls=%s]", r.Address, &r.HTTP, r.TLSClient)
 }
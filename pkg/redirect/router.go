@@ -1,31 +1,52 @@
 package redirect
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sort"
 	"sync"
+	"time"
 
-	"github.com/fsnotify/fsnotify"
+	"github.com/aiyengar2/portexporter/pkg/utils"
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 )
 
 const (
 	routePath = "/{scheme}/{host}{path:.*}"
+
+	// resyncInterval is how often watched files are read again regardless of whether a change was seen, in case the
+	// watcher misses one
+	resyncInterval = time.Minute
 )
 
 // router redirects incoming HTTP requests based on configured redirects
 type router struct {
 	*mux.Router
-	redirectHandlers map[string]http.Handler
-	redirectLock     sync.RWMutex
+	redirects    map[string]*registeredRedirect
+	redirectLock sync.RWMutex
+	watcher      *utils.FileWatcher
+	// updateLock serializes changes to the redirects so that handlers can be built without holding the redirect lock,
+	// which would block requests
+	updateLock sync.Mutex
+}
+
+// registeredRedirect is a redirect that has been registered with a router, along with the handler that currently serves it
+type registeredRedirect struct {
+	*Redirect
+	handler http.Handler
+	// stopWatch is called once the redirect is removed or replaced to stop watching its files
+	stopWatch func()
 }
 
 // Router returns a router that can add or remove redirects
 func Router() *router {
 	r := &router{
-		redirectHandlers: make(map[string]http.Handler),
+		redirects: make(map[string]*registeredRedirect),
+		watcher:   utils.NewFileWatcher(),
 	}
 	r.Router = mux.NewRouter()
 	r.HandleFunc(routePath, func(rw http.ResponseWriter, req *http.Request) {
@@ -43,11 +64,14 @@ func Router() *router {
 			// explicitly disable User-Agent so it's not set to default value
 			req.Header.Set("User-Agent", "")
 		}
-		// ensure that the handler for a redirect does not change while processing a request
+		// grab the redirect handler; a request that is in flight keeps using it even if the redirect is replaced or removed
 		r.redirectLock.RLock()
-		defer r.redirectLock.RUnlock()
-		// grab the redirect handler
-		handler, ok := r.redirectHandlers[address]
+		registered, ok := r.redirects[address]
+		var handler http.Handler
+		if ok {
+			handler = registered.handler
+		}
+		r.redirectLock.RUnlock()
 		if !ok {
 			http.Error(rw, fmt.Sprintf("redirect address %s has not been registered", address), http.StatusBadRequest)
 			return
@@ -59,41 +83,198 @@ func Router() *router {
 }
 
 // RegisterHandler configures a redirect to the provided address
-func (r *router) RegisterHandler(address string, redirect Redirect) error {
-	if _, ok := r.redirectHandlers[address]; ok {
+func (r *router) RegisterHandler(address string, redirect *Redirect) error {
+	r.updateLock.Lock()
+	defer r.updateLock.Unlock()
+	handler, err := redirect.ToHandler()
+	if err != nil {
+		return err
+	}
+
+	r.redirectLock.Lock()
+	defer r.redirectLock.Unlock()
+	if _, ok := r.redirects[address]; ok {
 		return fmt.Errorf("cannot register multiple redirects for address %s", address)
 	}
+	r.register(address, redirect, handler)
+	return nil
+}
+
+// UpdateHandler replaces the redirect to the provided address
+func (r *router) UpdateHandler(address string, redirect *Redirect) error {
+	r.updateLock.Lock()
+	defer r.updateLock.Unlock()
+	handler, err := redirect.ToHandler()
+	if err != nil {
+		return err
+	}
 
-	// add handler
 	r.redirectLock.Lock()
-	r.redirectHandlers[address] = redirect.ToHandler()
-	r.redirectLock.Unlock()
+	defer r.redirectLock.Unlock()
+	registered, ok := r.redirects[address]
+	if !ok {
+		return fmt.Errorf("redirect address %s has not been registered", address)
+	}
+	registered.stopWatch()
+	r.register(address, redirect, handler)
+	return nil
+}
 
-	// configure watcher for upgrading handler on file changes
-	go func() {
-		w, err := redirect.RestartWatcher()
+// Redirects returns the registered redirects, sorted by address
+func (r *router) Redirects() []*Redirect {
+	r.redirectLock.RLock()
+	defer r.redirectLock.RUnlock()
+	var redirects []*Redirect
+	for _, registered := range r.redirects {
+		redirects = append(redirects, registered.Redirect)
+	}
+	sort.Slice(redirects, func(i, j int) bool { return redirects[i].Address < redirects[j].Address })
+	return redirects
+}
+
+// Redirect returns the redirect registered for the provided address, or nil if there is none
+func (r *router) Redirect(address string) *Redirect {
+	r.redirectLock.RLock()
+	defer r.redirectLock.RUnlock()
+	if registered, ok := r.redirects[address]; ok {
+		return registered.Redirect
+	}
+	return nil
+}
+
+// UnregisterHandler removes the redirect to the provided address and stops watching its files
+func (r *router) UnregisterHandler(address string) error {
+	r.updateLock.Lock()
+	defer r.updateLock.Unlock()
+	r.redirectLock.Lock()
+	defer r.redirectLock.Unlock()
+	registered, ok := r.redirects[address]
+	if !ok {
+		return fmt.Errorf("redirect address %s has not been registered", address)
+	}
+	delete(r.redirects, address)
+	registered.stopWatch()
+	return nil
+}
+
+// Close stops watching the files of the redirects. The redirects continue to be served with the files they last read
+func (r *router) Close() error {
+	r.updateLock.Lock()
+	defer r.updateLock.Unlock()
+	r.redirectLock.Lock()
+	defer r.redirectLock.Unlock()
+	for _, registered := range r.redirects {
+		registered.stopWatch()
+	}
+	return r.watcher.Close()
+}
+
+// Reconcile adds, replaces and removes redirects so that the router serves exactly the provided ones. If any of the
+// redirects are invalid, none of the changes are made
+func (r *router) Reconcile(redirects []Redirect) error {
+	desired := make(map[string]*Redirect, len(redirects))
+	for i := range redirects {
+		redirect := &redirects[i]
+		if _, ok := desired[redirect.Address]; ok {
+			return fmt.Errorf("cannot register multiple redirects for address %s", redirect.Address)
+		}
+		desired[redirect.Address] = redirect
+	}
+
+	r.updateLock.Lock()
+	defer r.updateLock.Unlock()
+
+	// build the handlers of new and changed redirects before touching the ones that are being served. The redirects
+	// can only be changed while holding the update lock, so they can be read without the redirect lock
+	handlers := make(map[string]http.Handler)
+	for address, redirect := range desired {
+		if registered, ok := r.redirects[address]; ok && registered.String() == redirect.String() {
+			continue
+		}
+		handler, err := redirect.ToHandler()
 		if err != nil {
-			logrus.Errorf("unable to set up watcher for redirect %s", redirect)
+			return err
 		}
-		defer w.Close()
-		for {
-			select {
-			case event, ok := <-w.Events:
-				if !ok {
-					return
-				}
-				if event.Op&fsnotify.Write == fsnotify.Write {
-					r.redirectLock.Lock()
-					r.redirectHandlers[address] = redirect.ToHandler()
-					r.redirectLock.Unlock()
-				}
-			case err, ok := <-w.Errors:
-				if !ok {
-					return
-				}
-				logrus.Error(err)
-			}
+		handlers[address] = handler
+	}
+
+	r.redirectLock.Lock()
+	defer r.redirectLock.Unlock()
+	for address, registered := range r.redirects {
+		if _, ok := desired[address]; ok {
+			continue
 		}
-	}()
+		delete(r.redirects, address)
+		registered.stopWatch()
+		logrus.Infof("Removed redirect %s", registered.Redirect)
+	}
+	for address, handler := range handlers {
+		redirect := desired[address]
+		if registered, ok := r.redirects[address]; ok {
+			registered.stopWatch()
+			logrus.Infof("Updated redirect %s to %s", registered.Redirect, redirect)
+		} else {
+			logrus.Infof("Added redirect %s", redirect)
+		}
+		r.register(address, redirect, handler)
+	}
 	return nil
 }
+
+// register adds a redirect and starts watching its files. The caller must hold the update and redirect locks
+func (r *router) register(address string, redirect *Redirect, handler http.Handler) {
+	registered := &registeredRedirect{
+		Redirect:  redirect,
+		handler:   handler,
+		stopWatch: func() {},
+	}
+	r.redirects[address] = registered
+	var files []string
+	for _, file := range append(registered.CredentialFiles(), registered.CaCertFile) {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	if len(files) > 0 {
+		registered.stopWatch = r.watcher.Watch(files, resyncInterval, r.reloader(address, registered))
+	}
+}
+
+// reloader returns a function that reloads the credentials of a registered redirect and upgrades its handler when its
+// CA changes
+func (r *router) reloader(address string, registered *registeredRedirect) func() {
+	caCert := readFile(registered.CaCertFile)
+	return func() {
+		if changed, err := registered.ReloadCredentials(); err != nil {
+			logrus.Errorf("unable to reload credentials for redirect %s, continuing to use the previous credentials: %s", registered.Redirect, err)
+		} else if changed {
+			logrus.Infof("Reloaded credentials for redirect %s", address)
+		}
+
+		newCACert := readFile(registered.CaCertFile)
+		if bytes.Equal(newCACert, caCert) {
+			return
+		}
+		handler, err := registered.ToHandler()
+		if err != nil {
+			logrus.Errorf("unable to reload redirect %s, continuing to use the previous configuration: %s", registered.Redirect, err)
+			return
+		}
+		caCert = newCACert
+		r.redirectLock.Lock()
+		if r.redirects[address] == registered {
+			registered.handler = handler
+		}
+		r.redirectLock.Unlock()
+		logrus.Infof("Reloaded CA for redirect %s from %s", address, registered.CaCertFile)
+	}
+}
+
+// readFile returns the contents of a file, or nil if it is unset or cannot be read
+func readFile(path string) []byte {
+	if path == "" {
+		return nil
+	}
+	contents, _ := ioutil.ReadFile(path)
+	return contents
+}
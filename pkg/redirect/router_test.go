@@ -0,0 +1,115 @@
+package redirect
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aiyengar2/portexporter/pkg/config"
+)
+
+func TestRouterReconcile(t *testing.T) {
+	const (
+		a = "http://a.example.com"
+		b = "http://b.example.com"
+		c = "https://c.example.com"
+	)
+	insecure := config.TLSClient{InsecureSkipVerify: true}
+	tests := []struct {
+		name      string
+		initial   []Redirect
+		desired   []Redirect
+		want      []string
+		unchanged []string
+		wantErr   bool
+	}{
+		{
+			name:    "add",
+			desired: []Redirect{{Address: a}, {Address: b}},
+			want:    []string{a, b},
+		},
+		{
+			name:      "keep",
+			initial:   []Redirect{{Address: a}, {Address: b}},
+			desired:   []Redirect{{Address: b}, {Address: a}},
+			want:      []string{a, b},
+			unchanged: []string{a, b},
+		},
+		{
+			name:      "replace",
+			initial:   []Redirect{{Address: a}, {Address: c}},
+			desired:   []Redirect{{Address: a}, {Address: c, TLSClient: insecure}},
+			want:      []string{a, c},
+			unchanged: []string{a},
+		},
+		{
+			name:      "remove",
+			initial:   []Redirect{{Address: a}, {Address: b}},
+			desired:   []Redirect{{Address: b}},
+			want:      []string{b},
+			unchanged: []string{b},
+		},
+		{
+			name:    "add, replace and remove",
+			initial: []Redirect{{Address: a}, {Address: c}},
+			desired: []Redirect{{Address: b}, {Address: c, TLSClient: insecure}},
+			want:    []string{b, c},
+		},
+		{
+			name:    "remove all",
+			initial: []Redirect{{Address: a}, {Address: b}},
+		},
+		{
+			name:      "duplicate address",
+			initial:   []Redirect{{Address: a}},
+			desired:   []Redirect{{Address: b}, {Address: b}},
+			want:      []string{a},
+			unchanged: []string{a},
+			wantErr:   true,
+		},
+		{
+			name:    "invalid redirect",
+			initial: []Redirect{{Address: a}},
+			desired: []Redirect{
+				{Address: b},
+				{Address: c, HTTP: config.HTTP{UsernameFile: "/username"}},
+			},
+			want:      []string{a},
+			unchanged: []string{a},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := Router()
+			if err := r.Reconcile(tt.initial); err != nil {
+				t.Fatalf("Reconcile() of initial redirects failed: %s", err)
+			}
+			before := make(map[string]*registeredRedirect)
+			for address, registered := range r.redirects {
+				before[address] = registered
+			}
+
+			err := r.Reconcile(tt.desired)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Reconcile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, redirect := range r.Redirects() {
+				got = append(got, redirect.Address)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Reconcile() redirects = %v, want %v", got, tt.want)
+			}
+			unchanged := make(map[string]bool)
+			for _, address := range tt.unchanged {
+				unchanged[address] = true
+			}
+			for address, registered := range r.redirects {
+				if kept := before[address] == registered; kept != unchanged[address] {
+					t.Errorf("Reconcile() kept redirect %s = %v, want %v", address, kept, unchanged[address])
+				}
+			}
+			r.Close()
+		})
+	}
+}
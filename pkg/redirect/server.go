@@ -1,23 +1,45 @@
 package redirect
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"time"
 
+	"github.com/aiyengar2/portexporter/pkg/config"
+	"github.com/aiyengar2/portexporter/pkg/utils"
 	"github.com/sirupsen/logrus"
 )
 
 type redirectServer struct {
 	*http.Server
+
+	router   *router
+	useTLS   bool
+	listener net.Listener
 }
 
-func NewServer(listenAddr string, config Config) *redirectServer {
-	s := &redirectServer{}
-	router := Router()
-	for _, redirect := range config.Redirect {
-		router.RegisterHandler(redirect.Address, redirect)
+// NewServer returns a server for the redirects in the provided configuration, which serves TLS if tlsServer is enabled
+func NewServer(listenAddr string, config Config, tlsServer config.TLSServer) (*redirectServer, error) {
+	s := &redirectServer{
+		router: Router(),
+		useTLS: tlsServer.Enabled(),
+	}
+	var err error
+	s.listener, err = tlsServer.Listen(listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	for i := range config.Redirect {
+		redirect := &config.Redirect[i]
+		if err := s.router.RegisterHandler(redirect.Address, redirect); err != nil {
+			s.listener.Close()
+			s.router.Close()
+			return nil, err
+		}
 	}
 	s.Server = &http.Server{
 		Addr:         listenAddr,
@@ -26,15 +48,62 @@ func NewServer(listenAddr string, config Config) *redirectServer {
 		IdleTimeout:  time.Second * 60,
 		// disable HTTP/2 support
 		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
-		Handler:      router,
+		Handler:      s.router,
+	}
+	s.RegisterOnShutdown(func() {
+		s.router.Close()
+	})
+	return s, nil
+}
+
+// WatchConfig reloads the redirects served from a configuration file whenever it changes and every resyncInterval,
+// until the context is done. If the file cannot be loaded or contains an invalid redirect, the previous redirects
+// continue to be served and the file is loaded again on the next change or resync
+func (s *redirectServer) WatchConfig(ctx context.Context, configFile string) error {
+	// only reconcile the router when the contents of the file change, since other files in its directory may change too
+	loaded, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+	w := utils.NewFileWatcher()
+	stop := w.Watch([]string{configFile}, resyncInterval, func() {
+		configBytes, err := ioutil.ReadFile(configFile)
+		if err == nil && bytes.Equal(configBytes, loaded) {
+			return
+		}
+		if err == nil {
+			err = s.reconcile(configBytes)
+		}
+		if err != nil {
+			logrus.Errorf("unable to reload %s, continuing to use the previous redirects: %s", configFile, err)
+			return
+		}
+		loaded = configBytes
+	})
+	go func() {
+		<-ctx.Done()
+		stop()
+		w.Close()
+	}()
+	return nil
+}
+
+func (s *redirectServer) reconcile(configBytes []byte) error {
+	config, err := parse(configBytes)
+	if err != nil {
+		return err
 	}
-	return s
+	return s.router.Reconcile(config.Redirect)
 }
 
 func (s *redirectServer) Start(ctx context.Context) error {
-	logrus.Infof("Listening on %s", s.Addr)
 	go func() {
-		if err := s.ListenAndServe(); err != nil {
+		if !s.useTLS {
+			logrus.Infof("Listening for HTTP connections on %s", s.Addr)
+		} else {
+			logrus.Infof("Listening for TLS connections on %s", s.Addr)
+		}
+		if err := s.Serve(s.listener); err != nil {
 			logrus.Error(err)
 		}
 	}()
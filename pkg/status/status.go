@@ -0,0 +1,72 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aiyengar2/portexporter/pkg/config"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+// statusServer serves the health, status and metrics of a component on a local address
+type statusServer struct {
+	*http.Server
+
+	startTime time.Time
+}
+
+type componentStatus struct {
+	Uptime       string                     `json:"uptime"`
+	Certificates []config.CertificateExpiry `json:"certificates,omitempty"`
+}
+
+// NewServer returns a server for /healthz, /status and /metrics
+func NewServer(listenAddr string) *statusServer {
+	s := &statusServer{
+		startTime: time.Now(),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/status", s.status)
+	mux.Handle("/metrics", promhttp.Handler())
+	s.Server = &http.Server{
+		Addr:         listenAddr,
+		WriteTimeout: time.Second * 15,
+		ReadTimeout:  time.Second * 15,
+		IdleTimeout:  time.Second * 60,
+		Handler:      mux,
+	}
+	return s
+}
+
+func (s *statusServer) Start(ctx context.Context) {
+	logrus.Infof("Serving health, status and metrics on http://%s", s.Addr)
+	go func() {
+		if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logrus.Error(err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		s.Shutdown(context.Background())
+	}()
+}
+
+func (s *statusServer) healthz(rw http.ResponseWriter, req *http.Request) {
+	fmt.Fprint(rw, "ok")
+}
+
+func (s *statusServer) status(rw http.ResponseWriter, req *http.Request) {
+	status := componentStatus{
+		Uptime:       time.Since(s.startTime).Round(time.Second).String(),
+		Certificates: config.ExpiryStatus(),
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(status); err != nil {
+		logrus.Errorf("unable to encode status: %s", err)
+	}
+}
@@ -0,0 +1,220 @@
+package utils
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// debounceDelay is how long the files of a watch have to go unchanged before it is notified, so that files that
+	// are written in several steps (e.g. a key pair written one file at a time) are only reloaded once
+	debounceDelay = 100 * time.Millisecond
+
+	// rewatchInterval is how often directories that could not be watched, e.g. because they were removed, are retried
+	rewatchInterval = 10 * time.Second
+)
+
+// FileWatcher notifies watches when their files change, using a single inotify instance for all of them. Directories
+// are watched instead of the files themselves so that files replaced by a rename or a symlink swap (e.g. Kubernetes
+// Secret and ConfigMap volumes, which swap a ..data symlink) are seen
+type FileWatcher struct {
+	lock    sync.Mutex
+	watcher *fsnotify.Watcher
+	// failed is set if an inotify instance could not be created, in which case watches only resync
+	failed  bool
+	watched map[string]bool
+	watches map[*fileWatch]bool
+}
+
+type fileWatch struct {
+	files   []string
+	dirs    map[string]bool
+	changed chan struct{}
+}
+
+func NewFileWatcher() *FileWatcher {
+	return &FileWatcher{
+		watched: make(map[string]bool),
+		watches: make(map[*fileWatch]bool),
+	}
+}
+
+// Watch calls onChange whenever one of the files changes and, if resync is positive, every resync interval in case a
+// change was missed. It returns a function that stops the watch
+func (w *FileWatcher) Watch(files []string, resync time.Duration, onChange func()) func() {
+	fw := &fileWatch{
+		changed: make(chan struct{}, 1),
+	}
+	for _, file := range files {
+		if file != "" {
+			fw.files = append(fw.files, file)
+		}
+	}
+	stop := make(chan struct{})
+	if len(fw.files) > 0 {
+		w.lock.Lock()
+		w.start()
+		w.watches[fw] = true
+		w.addWatches(fw)
+		w.lock.Unlock()
+	}
+	go w.run(fw, stop, resync, onChange)
+
+	var stopOnce sync.Once
+	return func() {
+		stopOnce.Do(func() {
+			close(stop)
+			w.lock.Lock()
+			defer w.lock.Unlock()
+			delete(w.watches, fw)
+			w.removeUnusedWatches()
+		})
+	}
+}
+
+// Close stops watching for changes. Watches keep resyncing until they are stopped
+func (w *FileWatcher) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.watcher == nil {
+		return nil
+	}
+	return w.watcher.Close()
+}
+
+func (w *FileWatcher) run(fw *fileWatch, stop chan struct{}, resync time.Duration, onChange func()) {
+	var resyncs <-chan time.Time
+	if resync > 0 {
+		ticker := time.NewTicker(resync)
+		defer ticker.Stop()
+		resyncs = ticker.C
+	}
+	var reload <-chan time.Time
+	for {
+		select {
+		case <-stop:
+			return
+		case <-fw.changed:
+			reload = time.After(debounceDelay)
+			continue
+		case <-reload:
+			reload = nil
+		case <-resyncs:
+		}
+		w.lock.Lock()
+		w.addWatches(fw)
+		w.lock.Unlock()
+		onChange()
+	}
+}
+
+// start creates the inotify instance on first use. The caller must hold the lock
+func (w *FileWatcher) start() {
+	if w.watcher != nil || w.failed {
+		return
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logrus.Errorf("unable to watch files for changes, they will only be read again periodically: %s", err)
+		w.failed = true
+		return
+	}
+	w.watcher = watcher
+	go w.dispatch(watcher)
+}
+
+func (w *FileWatcher) dispatch(watcher *fsnotify.Watcher) {
+	ticker := time.NewTicker(rewatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			w.lock.Lock()
+			if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 && w.watched[event.Name] {
+				// the watch of a removed directory is gone, so it is added again once the directory is recreated
+				delete(w.watched, event.Name)
+			}
+			dir := filepath.Dir(event.Name)
+			for fw := range w.watches {
+				if fw.dirs[dir] || fw.dirs[event.Name] {
+					notify(fw)
+				}
+			}
+			w.lock.Unlock()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logrus.Error(err)
+		case <-ticker.C:
+			w.lock.Lock()
+			for fw := range w.watches {
+				if w.addWatches(fw) {
+					// the files may have changed while their directory was not watched
+					notify(fw)
+				}
+			}
+			w.lock.Unlock()
+		}
+	}
+}
+
+// addWatches watches the directory of each file of a watch and of the file that it links to, returning whether any
+// directory was newly watched. The caller must hold the lock
+func (w *FileWatcher) addWatches(fw *fileWatch) bool {
+	fw.dirs = make(map[string]bool)
+	for _, file := range fw.files {
+		fw.dirs[filepath.Dir(file)] = true
+		if target, err := filepath.EvalSymlinks(file); err == nil {
+			fw.dirs[filepath.Dir(target)] = true
+		}
+	}
+	if w.watcher == nil {
+		return false
+	}
+	var added bool
+	for dir := range fw.dirs {
+		if w.watched[dir] {
+			continue
+		}
+		if err := w.watcher.Add(dir); err != nil {
+			logrus.Debugf("unable to watch %s for changes: %s", dir, err)
+			continue
+		}
+		w.watched[dir] = true
+		added = true
+	}
+	return added
+}
+
+// removeUnusedWatches stops watching directories that no watch needs anymore. The caller must hold the lock
+func (w *FileWatcher) removeUnusedWatches() {
+	for dir := range w.watched {
+		used := false
+		for fw := range w.watches {
+			if fw.dirs[dir] {
+				used = true
+				break
+			}
+		}
+		if !used {
+			w.watcher.Remove(dir)
+			delete(w.watched, dir)
+		}
+	}
+}
+
+// notify marks a watch as changed without blocking if it already is
+func notify(fw *fileWatch) {
+	select {
+	case fw.changed <- struct{}{}:
+	default:
+	}
+}